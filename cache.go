@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A cache of responses shared by all workers. Concurrent lookups of the same key share a single in-flight request,
+// and the least recently used responses are evicted once the cache is full
+type ResponseCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+	// Most recently used entries are at the front
+	order   *list.List
+	maxSize int
+	ttl     time.Duration
+}
+
+type cacheEntry struct {
+	key      string
+	response Response
+	err      error
+	fetched  time.Time
+	element  *list.Element
+	// Closed once the response has been fetched
+	done chan struct{}
+}
+
+var baselineCache *ResponseCache
+
+// A maxSize of 0 disables caching, and a ttl of 0 keeps responses until they're evicted
+func newResponseCache(maxSize int, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		entries: make(map[string]*cacheEntry),
+		order:   list.New(),
+		maxSize: maxSize,
+		ttl:     ttl,
+	}
+}
+
+// Get the cached response for the key, or fetch it if it isn't cached. Failed requests aren't cached, but are
+// shared with any lookups that were waiting on them
+func (c *ResponseCache) get(key string, fetch func() (Response, error)) (Response, error) {
+	if c.maxSize <= 0 {
+		return fetch()
+	}
+
+	c.mutex.Lock()
+	if entry, ok := c.entries[key]; ok {
+		select {
+		case <-entry.done:
+			if c.ttl == 0 || time.Since(entry.fetched) < c.ttl {
+				c.order.MoveToFront(entry.element)
+				c.mutex.Unlock()
+				return entry.response, nil
+			}
+			c.remove(entry)
+		default:
+			c.mutex.Unlock()
+			<-entry.done
+			return entry.response, entry.err
+		}
+	}
+
+	entry := &cacheEntry{key: key, done: make(chan struct{})}
+	entry.element = c.order.PushFront(entry)
+	c.entries[key] = entry
+	for c.order.Len() > c.maxSize {
+		c.remove(c.order.Back().Value.(*cacheEntry))
+	}
+	c.mutex.Unlock()
+
+	entry.response, entry.err = fetch()
+	entry.fetched = time.Now()
+	close(entry.done)
+
+	if entry.err != nil {
+		c.mutex.Lock()
+		if c.entries[key] == entry {
+			c.remove(entry)
+		}
+		c.mutex.Unlock()
+	}
+	return entry.response, entry.err
+}
+
+// Must be called while holding the lock
+func (c *ResponseCache) remove(entry *cacheEntry) {
+	delete(c.entries, entry.key)
+	c.order.Remove(entry.element)
+}
+
+// Requests are cached by everything that's sent, as the same URL can be sent with different methods, headers or bodies
+func (r Request) cacheKey() string {
+	headers := make([]string, 0, len(r.Headers))
+	for header, value := range r.Headers {
+		headers = append(headers, strings.ToLower(header)+": "+value)
+	}
+	sort.Strings(headers)
+	return fmt.Sprintf("%v %v\n%v\n\n%v", r.Method, r.Url, strings.Join(headers, "\n"), r.Body)
+}
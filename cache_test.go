@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A fetch function that counts its calls, and returns the number of the call as the status code
+func countingFetch(calls *int32, err error) func() (Response, error) {
+	return func() (Response, error) {
+		call := atomic.AddInt32(calls, 1)
+		return Response{StatusCode: int(call)}, err
+	}
+}
+
+// Look up the key from several goroutines at once, with the fetch held until they've all started
+func concurrentGets(cache *ResponseCache, lookups int, fetch func() (Response, error)) ([]Response, []error) {
+	release := make(chan struct{})
+	heldFetch := func() (Response, error) {
+		<-release
+		return fetch()
+	}
+
+	var started, done sync.WaitGroup
+	responses := make([]Response, lookups)
+	errs := make([]error, lookups)
+	for i := 0; i < lookups; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			responses[i], errs[i] = cache.get("key", heldFetch)
+		}(i)
+	}
+	started.Wait()
+	// Give the goroutines time to reach the cache before the fetch completes
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	done.Wait()
+	return responses, errs
+}
+
+func TestResponseCacheSharesConcurrentFetches(t *testing.T) {
+	cache := newResponseCache(10, 0)
+	var calls int32
+	responses, errs := concurrentGets(cache, 20, countingFetch(&calls, nil))
+
+	if calls != 1 {
+		t.Errorf("fetch was called %v times, want 1", calls)
+	}
+	for i, resp := range responses {
+		if resp.StatusCode != 1 || errs[i] != nil {
+			t.Errorf("lookup %v got the response of call %v, and error %v", i, resp.StatusCode, errs[i])
+		}
+	}
+}
+
+func TestResponseCacheFailedFetches(t *testing.T) {
+	cache := newResponseCache(10, 0)
+	errFetch := errors.New("connection reset")
+	var calls int32
+
+	// Lookups waiting on a failed fetch get its error, rather than fetching again
+	_, errs := concurrentGets(cache, 10, countingFetch(&calls, errFetch))
+	for i, err := range errs {
+		if err != errFetch {
+			t.Errorf("lookup %v returned error %v, want %v", i, err, errFetch)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fetch was called %v times, want 1", calls)
+	}
+
+	// But the failure isn't cached
+	resp, err := cache.get("key", countingFetch(&calls, nil))
+	if err != nil || resp.StatusCode != 2 || calls != 2 {
+		t.Errorf("get after a failed fetch = %v, %v with %v calls, want a new fetch", resp.StatusCode, err, calls)
+	}
+	if _, ok := cache.entries["key"]; !ok {
+		t.Errorf("successful fetch after a failure wasn't cached")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newResponseCache(2, 0)
+	calls := make(map[string]*int32)
+	get := func(key string) {
+		if calls[key] == nil {
+			calls[key] = new(int32)
+		}
+		if _, err := cache.get(key, countingFetch(calls[key], nil)); err != nil {
+			t.Fatalf("get(%q) returned error: %v", key, err)
+		}
+	}
+
+	get("a")
+	get("b")
+	// a is now the most recently used, so b is evicted when c is added
+	get("a")
+	get("c")
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Errorf("cache has %v entries and %v in its order, want 2", len(cache.entries), cache.order.Len())
+	}
+
+	get("a")
+	get("b")
+	tests := map[string]int32{"a": 1, "b": 2, "c": 1}
+	for key, want := range tests {
+		if *calls[key] != want {
+			t.Errorf("%q was fetched %v times, want %v", key, *calls[key], want)
+		}
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	cache := newResponseCache(10, 50*time.Millisecond)
+	var calls int32
+	fetch := countingFetch(&calls, nil)
+
+	cache.get("key", fetch)
+	if resp, _ := cache.get("key", fetch); resp.StatusCode != 1 || calls != 1 {
+		t.Errorf("response was fetched again before it expired")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if resp, _ := cache.get("key", fetch); resp.StatusCode != 2 || calls != 2 {
+		t.Errorf("expired response wasn't fetched again")
+	}
+	if len(cache.entries) != 1 || cache.order.Len() != 1 {
+		t.Errorf("cache has %v entries and %v in its order after expiry, want 1", len(cache.entries), cache.order.Len())
+	}
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	cache := newResponseCache(0, 0)
+	var calls int32
+	fetch := countingFetch(&calls, nil)
+	for i := 0; i < 3; i++ {
+		cache.get("key", fetch)
+	}
+	if calls != 3 || len(cache.entries) != 0 {
+		t.Errorf("disabled cache fetched %v times and has %v entries, want 3 and 0", calls, len(cache.entries))
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A condition is a small boolean expression evaluated against the injected response, as well as the baseline and
+// heuristics responses, such as:
+//
+//	(code == 500 || body ~ "ORA-") && !header("Server") ~ "cloudflare"
+//
+// Supported operators (lowest to highest precedence) are ||, &&, ! and the comparisons ==, !=, <, <=, >, >=,
+// ~ (regex match) and !~ (regex does not match). Values are the response fields code, length, time and body, plus
+// header("Name"), each of which can be prefixed with baseline. or heuristics. to read from those responses instead.
+
+type valueKind int
+
+const (
+	kindBool valueKind = iota
+	kindNumber
+	kindString
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindBool:
+		return "bool"
+	case kindNumber:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+type conditionEnv struct {
+	Response           Response
+	BaselineResponse   Response
+	HeuristicsResponse Response
+}
+
+type conditionNode interface {
+	eval(env *conditionEnv) interface{}
+	kind() valueKind
+}
+
+type Condition struct {
+	source string
+	root   conditionNode
+	// The responses the condition reads from other than the injected response (baseline or heuristics)
+	responses map[string]bool
+}
+
+func compileCondition(source string) (*Condition, error) {
+	tokens, err := tokenizeCondition(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %v", source, err)
+	}
+
+	p := &conditionParser{tokens: tokens, responses: make(map[string]bool)}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = fmt.Errorf("unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+	if err == nil && root.kind() != kindBool {
+		err = fmt.Errorf("expression evaluates to a %v, not a bool", root.kind())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %v", source, err)
+	}
+
+	return &Condition{source: source, root: root, responses: p.responses}, nil
+}
+
+// Whether the condition reads from the baseline or heuristics response
+func (c *Condition) usesResponse(source string) bool {
+	return c.responses[source]
+}
+
+func (c *Condition) evaluate(resp Response, heuristicsResponse Response, baselineResponse Response) bool {
+	env := &conditionEnv{Response: resp, BaselineResponse: baselineResponse, HeuristicsResponse: heuristicsResponse}
+	return c.root.eval(env).(bool)
+}
+
+func (c *Condition) String() string {
+	return c.source
+}
+
+// Tokenizer
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+)
+
+type conditionToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// Operators are ordered so that longer operators are matched before their prefixes
+var conditionOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "!~", "<", ">", "~", "!"}
+
+func tokenizeCondition(source string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	i := 0
+	for i < len(source) {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, conditionToken{kind: tokenLeftParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, conditionToken{kind: tokenRightParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, conditionToken{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(source) && rune(source[end]) != c {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string starting at position %d", i)
+			}
+			text := source[i+1 : end]
+			if c == '"' {
+				unquoted, err := strconv.Unquote(source[i : end+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at position %d: %v", i, err)
+				}
+				text = unquoted
+			}
+			tokens = append(tokens, conditionToken{kind: tokenString, text: text, pos: i})
+			i = end + 1
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(source) && (unicode.IsDigit(rune(source[i])) || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, conditionToken{kind: tokenNumber, text: source[start:i], pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(source) && (unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i])) || source[i] == '_' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, conditionToken{kind: tokenIdent, text: source[start:i], pos: start})
+		default:
+			matched := false
+			for _, op := range conditionOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, conditionToken{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+		}
+	}
+	return append(tokens, conditionToken{kind: tokenEOF, text: "end of condition", pos: len(source)}), nil
+}
+
+// Parser
+
+type conditionParser struct {
+	tokens    []conditionToken
+	index     int
+	responses map[string]bool
+}
+
+func (p *conditionParser) peek() conditionToken {
+	return p.tokens[p.index]
+}
+
+func (p *conditionParser) next() conditionToken {
+	token := p.tokens[p.index]
+	if token.kind != tokenEOF {
+		p.index++
+	}
+	return token
+}
+
+func (p *conditionParser) acceptOperator(ops ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if token.text == op {
+			p.next()
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != kindBool || right.kind() != kindBool {
+			return nil, fmt.Errorf("|| requires bool operands, got %v and %v", left.kind(), right.kind())
+		}
+		left = &logicalNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != kindBool || right.kind() != kindBool {
+			return nil, fmt.Errorf("&& requires bool operands, got %v and %v", left.kind(), right.kind())
+		}
+		left = &logicalNode{op: "&&", left: left, right: right}
+	}
+}
+
+// Negation binds looser than comparisons, so !header("Server") ~ "x" negates the whole comparison
+func (p *conditionParser) parseNot() (conditionNode, error) {
+	if _, ok := p.acceptOperator("!"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if operand.kind() != kindBool {
+			return nil, fmt.Errorf("! requires a bool operand, got %v", operand.kind())
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (conditionNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	opToken := p.peek()
+	op, ok := p.acceptOperator("==", "!=", "<", "<=", ">", ">=", "~", "!~")
+	if !ok {
+		return left, nil
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "~", "!~":
+		if left.kind() != kindString || right.kind() != kindString {
+			return nil, fmt.Errorf("%v at position %d requires string operands, got %v and %v", op, opToken.pos, left.kind(), right.kind())
+		}
+		node := &regexNode{negate: op == "!~", left: left, right: right}
+		// Compile regex literals up front, so invalid patterns are reported when the config is loaded
+		if literal, ok := right.(*literalNode); ok {
+			re, err := regexp.Compile(literal.value.(string))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %v", literal.value, err)
+			}
+			node.compiled = re
+		}
+		return node, nil
+	case "<", "<=", ">", ">=":
+		if left.kind() != kindNumber || right.kind() != kindNumber {
+			return nil, fmt.Errorf("%v at position %d requires number operands, got %v and %v", op, opToken.pos, left.kind(), right.kind())
+		}
+	default:
+		if left.kind() != right.kind() {
+			return nil, fmt.Errorf("cannot compare %v with %v at position %d", left.kind(), right.kind(), opToken.pos)
+		}
+	}
+	return &comparisonNode{op: op, left: left, right: right}, nil
+}
+
+func (p *conditionParser) parseOperand() (conditionNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenLeftParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRightParen {
+			return nil, fmt.Errorf("expected ) at position %d, got %q", closing.pos, closing.text)
+		}
+		return node, nil
+	case tokenString:
+		return &literalNode{value: token.text, valueKind: kindString}, nil
+	case tokenNumber:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", token.text, token.pos)
+		}
+		return &literalNode{value: number, valueKind: kindNumber}, nil
+	case tokenIdent:
+		return p.parseIdentifier(token)
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", token.text, token.pos)
+	}
+}
+
+func (p *conditionParser) parseIdentifier(token conditionToken) (conditionNode, error) {
+	switch token.text {
+	case "true", "false":
+		return &literalNode{value: token.text == "true", valueKind: kindBool}, nil
+	}
+
+	source := "response"
+	name := token.text
+	if i := strings.Index(name, "."); i != -1 {
+		source, name = name[:i], name[i+1:]
+		if source != "baseline" && source != "heuristics" {
+			return nil, fmt.Errorf("unknown response %q at position %d (expected baseline or heuristics)", source, token.pos)
+		}
+		p.responses[source] = true
+	}
+
+	field := &fieldNode{source: source, name: name}
+	switch name {
+	case "code", "length", "time":
+		field.valueKind = kindNumber
+	case "body":
+		field.valueKind = kindString
+	case "header":
+		if open := p.next(); open.kind != tokenLeftParen {
+			return nil, fmt.Errorf("expected ( after header at position %d", open.pos)
+		}
+		arg := p.next()
+		if arg.kind != tokenString {
+			return nil, fmt.Errorf("header() expects a string header name at position %d", arg.pos)
+		}
+		if closing := p.next(); closing.kind != tokenRightParen {
+			return nil, fmt.Errorf("expected ) at position %d, got %q", closing.pos, closing.text)
+		}
+		field.header = arg.text
+		field.valueKind = kindString
+	default:
+		return nil, fmt.Errorf("unknown value %q at position %d", token.text, token.pos)
+	}
+	return field, nil
+}
+
+// Nodes
+
+type literalNode struct {
+	value     interface{}
+	valueKind valueKind
+}
+
+func (n *literalNode) eval(env *conditionEnv) interface{} { return n.value }
+func (n *literalNode) kind() valueKind                    { return n.valueKind }
+
+type fieldNode struct {
+	source    string
+	name      string
+	header    string
+	valueKind valueKind
+}
+
+func (n *fieldNode) eval(env *conditionEnv) interface{} {
+	resp := env.Response
+	switch n.source {
+	case "baseline":
+		resp = env.BaselineResponse
+	case "heuristics":
+		resp = env.HeuristicsResponse
+	}
+
+	switch n.name {
+	case "code":
+		return float64(resp.StatusCode)
+	case "length":
+		return float64(resp.ContentLength)
+	case "time":
+		return resp.Duration.Seconds()
+	case "body":
+		return resp.Body
+	default:
+		return resp.Headers.Get(n.header)
+	}
+}
+
+func (n *fieldNode) kind() valueKind { return n.valueKind }
+
+type logicalNode struct {
+	op          string
+	left, right conditionNode
+}
+
+func (n *logicalNode) eval(env *conditionEnv) interface{} {
+	left := n.left.eval(env).(bool)
+	if n.op == "||" {
+		return left || n.right.eval(env).(bool)
+	}
+	return left && n.right.eval(env).(bool)
+}
+
+func (n *logicalNode) kind() valueKind { return kindBool }
+
+type notNode struct {
+	operand conditionNode
+}
+
+func (n *notNode) eval(env *conditionEnv) interface{} { return !n.operand.eval(env).(bool) }
+func (n *notNode) kind() valueKind                    { return kindBool }
+
+type comparisonNode struct {
+	op          string
+	left, right conditionNode
+}
+
+func (n *comparisonNode) eval(env *conditionEnv) interface{} {
+	left, right := n.left.eval(env), n.right.eval(env)
+	switch n.op {
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	}
+
+	l, r := left.(float64), right.(float64)
+	switch n.op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	default:
+		return l >= r
+	}
+}
+
+func (n *comparisonNode) kind() valueKind { return kindBool }
+
+type regexNode struct {
+	negate      bool
+	left, right conditionNode
+	compiled    *regexp.Regexp
+}
+
+func (n *regexNode) eval(env *conditionEnv) interface{} {
+	re := n.compiled
+	if re == nil {
+		var err error
+		// Patterns that aren't literals (i.e. baseline.body) are matched literally rather than as a regex
+		re, err = regexp.Compile(regexp.QuoteMeta(n.right.eval(env).(string)))
+		if err != nil {
+			return false
+		}
+	}
+	return re.MatchString(n.left.eval(env).(string)) != n.negate
+}
+
+func (n *regexNode) kind() valueKind { return kindBool }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenizeCondition(t *testing.T) {
+	tests := []struct {
+		source string
+		tokens []string
+	}{
+		{`code==500`, []string{"ident:code", "op:==", "number:500"}},
+		{`  code  !=  500  `, []string{"ident:code", "op:!=", "number:500"}},
+		{`body !~ "x"`, []string{"ident:body", "op:!~", "string:x"}},
+		{`!body ~ "x"`, []string{"op:!", "ident:body", "op:~", "string:x"}},
+		{`!!true`, []string{"op:!", "op:!", "ident:true"}},
+		{`time>=1.5&&length<=10`, []string{"ident:time", "op:>=", "number:1.5", "op:&&", "ident:length", "op:<=", "number:10"}},
+		{`a||b`, []string{"ident:a", "op:||", "ident:b"}},
+		{`baseline.code < heuristics.code`, []string{"ident:baseline.code", "op:<", "ident:heuristics.code"}},
+		{`header("X-Frame-Options")`, []string{"ident:header", "(", "string:X-Frame-Options", ")"}},
+		{`"a\"b\n"`, []string{"string:a\"b\n"}},
+		{`'a\'b'`, []string{`string:a\'b`}},
+		{`'ORA-\d+'`, []string{`string:ORA-\d+`}},
+		{`f(a, b)`, []string{"ident:f", "(", "ident:a", ",", "ident:b", ")"}},
+		{``, nil},
+	}
+
+	kinds := map[tokenKind]string{tokenIdent: "ident:", tokenNumber: "number:", tokenString: "string:", tokenOperator: "op:"}
+	for _, test := range tests {
+		tokens, err := tokenizeCondition(test.source)
+		if err != nil {
+			t.Errorf("tokenizeCondition(%q) returned error: %v", test.source, err)
+			continue
+		}
+		if last := tokens[len(tokens)-1]; last.kind != tokenEOF || last.pos != len(test.source) {
+			t.Errorf("tokenizeCondition(%q) didn't end with EOF at %d: %+v", test.source, len(test.source), last)
+		}
+
+		var got []string
+		for _, token := range tokens[:len(tokens)-1] {
+			got = append(got, kinds[token.kind]+token.text)
+		}
+		if !reflect.DeepEqual(got, test.tokens) {
+			t.Errorf("tokenizeCondition(%q) = %q, want %q", test.source, got, test.tokens)
+		}
+	}
+}
+
+func TestTokenizeConditionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{`body ~ "x`, "unterminated string starting at position 7"},
+		{`body ~ 'x\'`, "unterminated string"},
+		{`body ~ "\q"`, "invalid string at position 7"},
+		{`code = 500`, "unexpected character '=' at position 5"},
+		{`code == 500 # comment`, "unexpected character '#'"},
+		{`code & 1`, "unexpected character '&'"},
+	}
+
+	for _, test := range tests {
+		_, err := tokenizeCondition(test.source)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("tokenizeCondition(%q) error = %v, want %q", test.source, err, test.err)
+		}
+	}
+}
+
+func TestCompileConditionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{`code`, "evaluates to a number, not a bool"},
+		{`body`, "evaluates to a string, not a bool"},
+		{`code == "500"`, "cannot compare number with string"},
+		{`code ~ "5"`, "~ at position 5 requires string operands"},
+		{`body < 5`, "< at position 5 requires number operands"},
+		{`!code`, "! requires a bool operand"},
+		{`code || true`, "|| requires bool operands"},
+		{`true && body`, "&& requires bool operands"},
+		{`(code == 500`, "expected ) at position 12"},
+		{`code == 500)`, `unexpected ")" at position 11`},
+		{`code == 500 code`, `unexpected "code" at position 12`},
+		{`code ==`, "unexpected \"end of condition\""},
+		{`status == 500`, `unknown value "status"`},
+		{`response.code == 500`, `unknown response "response"`},
+		{`header == "x"`, "expected ( after header"},
+		{`header(Server) == "x"`, "header() expects a string header name"},
+		{`header("Server" == "x"`, "expected ) at position 16"},
+		{`body ~ "("`, `invalid regex "("`},
+		{`code == 1.2.3`, `invalid number "1.2.3"`},
+	}
+
+	for _, test := range tests {
+		_, err := compileCondition(test.source)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("compileCondition(%q) error = %v, want %q", test.source, err, test.err)
+		}
+	}
+}
+
+func TestConditionEvaluate(t *testing.T) {
+	resp := Response{
+		StatusCode:    500,
+		Body:          "ORA-00933: SQL command not properly ended",
+		Headers:       http.Header{"Server": []string{"cloudflare"}},
+		ContentLength: 41,
+		Duration:      1500 * time.Millisecond,
+	}
+	baseline := Response{StatusCode: 200, Body: "ok", Headers: http.Header{}}
+	heuristics := Response{StatusCode: 500, Body: "ORA-00933: SQL command not properly ended", Headers: http.Header{}}
+
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{`code == 500`, true},
+		{`code != 500`, false},
+		{`code >= 500 && code < 600`, true},
+		{`length > 40 && length <= 41`, true},
+		{`time >= 1.5`, true},
+		{`time > 1.5`, false},
+		{`body ~ "ORA-[0-9]+"`, true},
+		{`body ~ "MySQL"`, false},
+		{`body !~ "MySQL"`, true},
+		{`header("server") ~ "cloudflare"`, true},
+		{`header("X-Missing") == ""`, true},
+
+		// ! binds looser than comparisons, so it negates the whole comparison
+		{`!header("Server") ~ "cloudflare"`, false},
+		{`!code == 200`, true},
+		{`!body ~ "MySQL"`, true},
+		{`!!true`, true},
+		{`!(code == 500 || code == 200)`, false},
+
+		// && binds tighter than ||
+		{`code == 200 || code == 500 && body ~ "ORA-"`, true},
+		{`code == 500 || code == 200 && body ~ "MySQL"`, true},
+		{`(code == 500 || code == 200) && body ~ "MySQL"`, false},
+		{`code == 200 && body ~ "ORA-" || true`, true},
+		{`false || false || code == 500`, true},
+		{`true && true && code == 200`, false},
+
+		{`baseline.code != code`, true},
+		{`baseline.body == "ok" && heuristics.code == code`, true},
+		{`heuristics.body == body`, true},
+		// Patterns that aren't literals are matched literally
+		{`body ~ heuristics.body`, true},
+		{`body ~ baseline.body`, false},
+	}
+
+	for _, test := range tests {
+		condition, err := compileCondition(test.source)
+		if err != nil {
+			t.Errorf("compileCondition(%q) returned error: %v", test.source, err)
+			continue
+		}
+		if got := condition.evaluate(resp, heuristics, baseline); got != test.want {
+			t.Errorf("%q evaluated to %v, want %v", test.source, got, test.want)
+		}
+	}
+}
+
+func TestConditionUsesResponse(t *testing.T) {
+	tests := []struct {
+		source     string
+		baseline   bool
+		heuristics bool
+	}{
+		{`code == 500`, false, false},
+		{`baseline.code != code`, true, false},
+		{`heuristics.header("Server") == ""`, false, true},
+		{`baseline.length < length || heuristics.time > 1`, true, true},
+	}
+
+	for _, test := range tests {
+		condition, err := compileCondition(test.source)
+		if err != nil {
+			t.Errorf("compileCondition(%q) returned error: %v", test.source, err)
+			continue
+		}
+		if got := condition.usesResponse("baseline"); got != test.baseline {
+			t.Errorf("%q uses the baseline response = %v, want %v", test.source, got, test.baseline)
+		}
+		if got := condition.usesResponse("heuristics"); got != test.heuristics {
+			t.Errorf("%q uses the heuristics response = %v, want %v", test.source, got, test.heuristics)
+		}
+	}
+}
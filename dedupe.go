@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// Input requests are deduplicated as they're read, either exactly (remembering every request) or with a fixed
+// size bloom filter, which uses far less memory on large inputs but can occasionally skip a request that's unique
+type dedupeSet interface {
+	// Add the key to the set, returning whether it's new
+	add(key string) bool
+}
+
+type exactSet map[string]bool
+
+func (s exactSet) add(key string) bool {
+	if s[key] {
+		return false
+	}
+	s[key] = true
+	return true
+}
+
+// False positive rate of bloom filters, when holding the number of keys they're sized for
+const bloomFalsePositiveRate = 0.001
+
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes uint64
+}
+
+func newBloomFilter(expectedKeys int) *bloomFilter {
+	size := uint64(math.Ceil(-float64(expectedKeys) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := uint64(math.Ceil(float64(size) / float64(expectedKeys) * math.Ln2))
+	if size < 64 {
+		size = 64
+	}
+	return &bloomFilter{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+}
+
+func (f *bloomFilter) add(key string) bool {
+	hash := fnv.New128a()
+	hash.Write([]byte(key))
+	sum := hash.Sum(nil)
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])
+
+	isNew := false
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			isNew = true
+			f.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return isNew
+}
+
+func newDedupeSet(size int) dedupeSet {
+	if size > 0 {
+		return newBloomFilter(size)
+	}
+	return make(exactSet)
+}
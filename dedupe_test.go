@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewBloomFilterSizing(t *testing.T) {
+	tests := []struct {
+		expectedKeys int
+		size         uint64
+		hashes       uint64
+		words        int
+	}{
+		// Small filters are never smaller than a single word
+		{1, 64, 11, 1},
+		{10, 144, 10, 3},
+		{100, 1438, 10, 23},
+		{1000, 14378, 10, 225},
+		// About 1.8MB for a million keys
+		{1000000, 14377588, 10, 224650},
+	}
+
+	for _, test := range tests {
+		f := newBloomFilter(test.expectedKeys)
+		if f.size != test.size || f.hashes != test.hashes || len(f.bits) != test.words {
+			t.Errorf("newBloomFilter(%v) has size %v, %v hashes and %v words, want %v, %v and %v",
+				test.expectedKeys, f.size, f.hashes, len(f.bits), test.size, test.hashes, test.words)
+		}
+		if uint64(len(f.bits))*64 < f.size {
+			t.Errorf("newBloomFilter(%v) has %v bits for a size of %v", test.expectedKeys, len(f.bits)*64, f.size)
+		}
+	}
+}
+
+func TestBloomFilterAdd(t *testing.T) {
+	f := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("GET example.com/path?id&q %v", i)
+		f.add(key)
+		if f.add(key) {
+			t.Fatalf("%q was added twice", key)
+		}
+	}
+
+	// Keys that weren't added should only rarely be reported as duplicates, when the filter holds what it was sized for.
+	// Adding a key changes the filter, so it's reset after each one
+	filled := append([]uint64(nil), f.bits...)
+	falsePositives := 0
+	for i := 0; i < 100000; i++ {
+		if !f.add(fmt.Sprintf("POST other.com/%v", i)) {
+			falsePositives++
+		}
+		copy(f.bits, filled)
+	}
+	if rate := float64(falsePositives) / 100000; rate > bloomFalsePositiveRate*3 {
+		t.Errorf("false positive rate was %v, want about %v", rate, bloomFalsePositiveRate)
+	}
+}
+
+func TestNewDedupeSet(t *testing.T) {
+	tests := []struct {
+		size  int
+		bloom bool
+	}{
+		{0, false},
+		{-1, false},
+		{1, true},
+		{100000, true},
+	}
+
+	for _, test := range tests {
+		set := newDedupeSet(test.size)
+		if _, ok := set.(*bloomFilter); ok != test.bloom {
+			t.Errorf("newDedupeSet(%v) returned %T", test.size, set)
+		}
+		if !set.add("a") || set.add("a") || !set.add("b") {
+			t.Errorf("newDedupeSet(%v) didn't deduplicate keys", test.size)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Encoders transform payloads before they're injected, to get them past filters. Rules list encoder chains, such
+// as base64|urlencode, which are applied from left to right
+var encoders = map[string]func(string) string{
+	"urlencode": urlEncode,
+	"doubleurl": func(payload string) string { return urlEncode(urlEncode(payload)) },
+	"base64":    func(payload string) string { return base64.StdEncoding.EncodeToString([]byte(payload)) },
+	"html":      func(payload string) string { return encodeSpecialCharacters(payload, "&#%d;") },
+	"unicode":   func(payload string) string { return encodeSpecialCharacters(payload, "\\u%04x") },
+	"hex":       hexEncode,
+	"mixedcase": mixedCase,
+}
+
+func encoderNames() []string {
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateEncoderChain(chain string) error {
+	for _, name := range strings.Split(chain, "|") {
+		if _, ok := encoders[strings.TrimSpace(name)]; !ok {
+			return fmt.Errorf("unsupported encoder %q in %q (expected one of: %v)", strings.TrimSpace(name), chain, strings.Join(encoderNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// Apply an encoder chain to a payload. An empty chain leaves the payload as it is
+func encodePayload(payload string, chain string) string {
+	if chain == "" {
+		return payload
+	}
+	for _, name := range strings.Split(chain, "|") {
+		payload = encoders[strings.TrimSpace(name)](payload)
+	}
+	return payload
+}
+
+// Percent encode everything other than unreserved characters (letters, digits, -, ., _ and ~)
+func urlEncode(payload string) string {
+	return strings.Replace(url.QueryEscape(payload), "+", "%20", -1)
+}
+
+// Letters and digits are left as they are, so tokens such as [[canary]] can still be found in responses
+func encodeSpecialCharacters(payload string, format string) string {
+	var encoded strings.Builder
+	for _, character := range payload {
+		if unicode.IsLetter(character) || unicode.IsDigit(character) {
+			encoded.WriteRune(character)
+		} else {
+			encoded.WriteString(fmt.Sprintf(format, character))
+		}
+	}
+	return encoded.String()
+}
+
+// Hex escapes are per byte, so multi-byte characters are escaped as their UTF-8 bytes
+func hexEncode(payload string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(payload); i++ {
+		c := payload[i]
+		if c < 0x80 && (isLetter(c) || (c >= '0' && c <= '9')) {
+			encoded.WriteByte(c)
+		} else {
+			encoded.WriteString(fmt.Sprintf("\\x%02x", c))
+		}
+	}
+	return encoded.String()
+}
+
+// Alternate the case of letters (i.e. SeLeCt), to get past case sensitive keyword filters
+func mixedCase(payload string) string {
+	var mixed strings.Builder
+	upper := true
+	for _, character := range payload {
+		if !unicode.IsLetter(character) {
+			mixed.WriteRune(character)
+			continue
+		}
+		if upper {
+			mixed.WriteRune(unicode.ToUpper(character))
+		} else {
+			mixed.WriteRune(unicode.ToLower(character))
+		}
+		upper = !upper
+	}
+	return mixed.String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodePayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		chain   string
+		encoded string
+	}{
+		{`"><script>`, "", `"><script>`},
+		{"<a b>", "urlencode", "%3Ca%20b%3E"},
+		{"a-b_c.d~e", "urlencode", "a-b_c.d~e"},
+		{"<", "doubleurl", "%253C"},
+		{"abc", "base64", "YWJj"},
+		{`"<é`, "html", "&#34;&#60;é"},
+		{"<aé", "unicode", `\u003caé`},
+		// Hex escapes are per byte
+		{"<é", "hex", `\x3c\xc3\xa9`},
+		{"select * from", "mixedcase", "SeLeCt * FrOm"},
+		// Tokens keep their letters and digits, other than with base64 and mixedcase
+		{"'abc123def'", "html", "&#39;abc123def&#39;"},
+		{"abc123def", "mixedcase", "AbC123dEf"},
+
+		// Chains are applied from left to right
+		{"a?", "base64|urlencode", "YT8%3D"},
+		{"a?", "urlencode|base64", "YSUzRg=="},
+		{"UNION SELECT", "mixedcase|urlencode", "UnIoN%20sElEcT"},
+		{"<", "urlencode|urlencode", "%253C"},
+		{"<", " html | urlencode ", "%26%2360%3B"},
+	}
+
+	for _, test := range tests {
+		if encoded := encodePayload(test.payload, test.chain); encoded != test.encoded {
+			t.Errorf("encodePayload(%q, %q) = %q, want %q", test.payload, test.chain, encoded, test.encoded)
+		}
+	}
+}
+
+func TestValidateEncoderChain(t *testing.T) {
+	tests := []struct {
+		chain string
+		err   string
+	}{
+		{"base64", ""},
+		{" base64 | urlencode ", ""},
+		{"mixedcase|html|unicode|hex|doubleurl", ""},
+		{"", `unsupported encoder ""`},
+		{"base64||html", `unsupported encoder "" in "base64||html"`},
+		{"base64|", `unsupported encoder ""`},
+		{"rot13", `unsupported encoder "rot13"`},
+		{"Base64", `unsupported encoder "Base64"`},
+	}
+
+	for _, test := range tests {
+		err := validateEncoderChain(test.chain)
+		if test.err == "" && err != nil {
+			t.Errorf("validateEncoderChain(%q) returned error: %v", test.chain, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("validateEncoderChain(%q) error = %v, want %q", test.chain, err, test.err)
+		}
+	}
+}
+
+// Encoded variants are sent to get past filters, so reflections are compared with the payload before it was encoded
+func TestEncodedPayloadReflections(t *testing.T) {
+	rule := Rule{
+		Injections: []string{`"><h2>[[canary]]`},
+		Encoders:   []string{"urlencode", "html", "base64"},
+		Expectation: ExpectedResponse{
+			Reflection: &ReflectionExpectation{Contexts: []string{"html"}, Unencoded: []string{"<", ">"}},
+		},
+	}
+	if err := rule.Expectation.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	injections, err := getInjectedRequests(Request{Method: "GET", Url: "https://example.com/search?q=test"}, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chains []string
+	for _, injection := range injections {
+		chains = append(chains, injection.Encoders)
+		if injection.UnencodedPayload != `"><h2>`+injection.Token {
+			t.Errorf("%q has the unencoded payload %q", injection.Encoders, injection.UnencodedPayload)
+		}
+
+		// A target that decodes the payload and reflects it as it is
+		resp := Response{
+			Body:    "<p>" + injection.UnencodedPayload + "</p>",
+			Headers: http.Header{"Content-Type": []string{"text/html"}},
+		}
+		evaluation := rule.evaluate(resp, injection, "xss", Response{}, Response{})
+		if !evaluation.Successful {
+			t.Errorf("%q wasn't matched, reflections: %v", injection.Encoders, evaluation.Reflections)
+		}
+	}
+	if want := []string{"", "urlencode", "html", "base64"}; !reflect.DeepEqual(chains, want) {
+		t.Errorf("injections were encoded with %q, want %q", chains, want)
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func (r *Rule) evaluate(resp Response, urlInjection UrlInjection, ruleName string, heuristicsResponse Response, baselineResponse Response) RuleEvaluation {
+func (r *Rule) evaluate(resp Response, requestInjection RequestInjection, ruleName string, heuristicsResponse Response, baselineResponse Response) RuleEvaluation {
 	headersExpected := false
 	bodyExpected := false
 	codeExpected := false
@@ -24,75 +26,148 @@ func (r *Rule) evaluate(resp Response, urlInjection UrlInjection, ruleName strin
 
 	var ruleEvaluation RuleEvaluation
 
-	if r.Expectation.Headers != nil  || heuristicsExpected["responseheader"] {
+	if r.Expectation.Headers != nil || r.Expectation.HeadersRegex != nil || heuristicsExpected["responseheader"] {
 		headersExpected = true
 		numOfChecks += 1
 	}
 
-	if r.Expectation.Contents != nil  || heuristicsExpected["responsecontent"] {
+	if r.Expectation.Contents != nil || r.Expectation.ContentsRegex != nil || heuristicsExpected["responsecontent"] {
 		bodyExpected = true
 		numOfChecks += 1
 	}
 
-	if r.Expectation.Codes != nil  || heuristicsExpected["responsecode"] {
+	if r.Expectation.Codes != nil || heuristicsExpected["responsecode"] {
 		codeExpected = true
 		numOfChecks += 1
 	}
 
-	if r.Expectation.Lengths != nil  || heuristicsExpected["responselength"] {
+	if r.Expectation.Lengths != nil || heuristicsExpected["responselength"] {
 		lengthExpected = true
 		numOfChecks += 1
 	}
 
+	// Negated expectations are each their own category, and all values within them must hold
+	if r.Expectation.ContentsNot != nil {
+		numOfChecks += 1
+		if matched := r.evaluateContentNot(resp.Body); matched {
+			ruleEvaluation.addMatchedCheck("responseContentsNot")
+		}
+	}
+
+	if r.Expectation.CodesNot != nil {
+		numOfChecks += 1
+		if matched := r.evaluateStatusCodeNot(resp.StatusCode); matched {
+			ruleEvaluation.addMatchedCheck("responseCodesNot")
+		}
+	}
+
+	if r.Expectation.HeadersAbsent != nil {
+		numOfChecks += 1
+		if matched := r.evaluateHeadersAbsent(resp.Headers); matched {
+			ruleEvaluation.addMatchedCheck("responseHeadersAbsent")
+		}
+	}
+
+	if r.Expectation.Times != nil {
+		numOfChecks += 1
+		if matched := r.evaluateResponseTime(resp.Duration); matched {
+			ruleEvaluation.addMatchedCheck("responseTime")
+		}
+	}
+
+	// Reflections are found by the task's token, and must be in one of the expected contexts
+	if r.Expectation.Reflection != nil {
+		numOfChecks += 1
+		reflections := analyzeReflections(resp, requestInjection.UnencodedPayload, requestInjection.Token)
+		if matched := r.Expectation.Reflection.matches(reflections); len(matched) > 0 {
+			ruleEvaluation.addMatchedCheck("reflection")
+			ruleEvaluation.Reflections = matched
+		}
+	}
+
+	// A condition is evaluated as its own category, so it must hold in addition to any other expectations
+	if r.condition != nil {
+		numOfChecks += 1
+		if matched := r.condition.evaluate(resp, heuristicsResponse, baselineResponse); matched {
+			ruleEvaluation.addMatchedCheck("condition")
+		}
+	}
+
 	if bodyExpected {
 		if matched := r.evaluateContent(resp.Body, heuristicsResponse, baselineResponse, heuristicsExpected["responsecontent"]); matched {
-			ruleEvaluation.ChecksMatched += 1
+			ruleEvaluation.addMatchedCheck("responseContents")
 		}
 	}
 
 	if codeExpected {
 		if matched := r.evaluateStatusCode(resp.StatusCode, heuristicsResponse, baselineResponse, heuristicsExpected["responsecode"]); matched {
-			ruleEvaluation.ChecksMatched += 1
+			ruleEvaluation.addMatchedCheck("responseCodes")
 		}
 	}
 
 	if headersExpected {
 		if matched := r.evaluateHeaders(resp.Headers, heuristicsResponse, baselineResponse, heuristicsExpected["responseheader"]); matched {
-			ruleEvaluation.ChecksMatched += 1
+			ruleEvaluation.addMatchedCheck("responseHeaders")
 		}
 	}
 
 	if lengthExpected {
 		if matched := r.evaluateContentLength(resp.ContentLength, heuristicsResponse, baselineResponse, heuristicsExpected["responselength"]); matched {
-			ruleEvaluation.ChecksMatched += 1
+			ruleEvaluation.addMatchedCheck("responseLength")
 		}
 	}
 
 	if ruleEvaluation.ChecksMatched > 0 && ruleEvaluation.ChecksMatched >= numOfChecks {
 		ruleEvaluation.Successful = true
-		u, err := url.QueryUnescape(urlInjection.InjectedUrl)
-		if err != nil {
-			u = urlInjection.InjectedUrl
+		var details []string
+		if len(ruleEvaluation.Reflections) > 0 {
+			details = append(details, ruleEvaluation.Reflections[0].String())
 		}
-		// Sprintf expects format string and arguments so URL encoded values will show up as (MISSING)
-		// when printed. This will URL decode until fully decoded when printing for readability
-		for strings.Contains(u, "%") {
-			decodedUrl, err := url.QueryUnescape(u)
-			if err != nil {
-				break
-			}
-			u = decodedUrl
+		ruleEvaluation.SuccessMessage = fmt.Sprintf("[%s] successful match for %v\n", ruleName, describeInjection(requestInjection, details...))
+	}
+
+	return ruleEvaluation
+}
+
+// Describe the injected request for printing, including which header, cookie or marker was injected as they may not
+// be visible in the URL or body, the encoders used, and any other details
+func describeInjection(requestInjection RequestInjection, details ...string) string {
+	u, err := url.QueryUnescape(requestInjection.Injected.String())
+	if err != nil {
+		u = requestInjection.Injected.String()
+	}
+	// Sprintf expects format string and arguments so URL encoded values will show up as (MISSING)
+	// when printed. This will URL decode until fully decoded when printing for readability
+	for strings.Contains(u, "%") {
+		decodedUrl, err := url.QueryUnescape(u)
+		if err != nil {
+			break
 		}
+		u = decodedUrl
+	}
+
+	var parts []string
+	if requestInjection.Location == "header" || requestInjection.Location == "cookie" || requestInjection.Location == "marker" {
+		parts = append(parts, fmt.Sprintf("%v: %v", requestInjection.Location, requestInjection.Parameter))
+	}
+	if requestInjection.Encoders != "" {
+		parts = append(parts, "encoders: "+requestInjection.Encoders)
+	}
+	parts = append(parts, details...)
 
-		ruleEvaluation.SuccessMessage = fmt.Sprintf("[%s] successful match for %v\n", ruleName, u)
-		evaluationResults = append(evaluationResults, EvaluationResult{RuleName: ruleName, RuleDescription: r.Description, InjectedUrl: urlInjection.InjectedUrl})
+	if len(parts) == 0 {
+		return u
 	}
+	return fmt.Sprintf("%v (%v)", u, strings.Join(parts, ", "))
+}
 
-	return ruleEvaluation
+func (e *RuleEvaluation) addMatchedCheck(check string) {
+	e.ChecksMatched += 1
+	e.MatchedChecks = append(e.MatchedChecks, check)
 }
 
 func (r *Rule) evaluateContent(responseContent string, heuristicsResponse Response, baselineResponse Response, heuristicExpected bool) bool {
-	if heuristicExpected && len(r.Expectation.Contents) == 0 {
+	if heuristicExpected && len(r.Expectation.Contents) == 0 && len(r.Expectation.contentsRegex) == 0 {
 		if heuristicsResponse.Body == baselineResponse.Body {
 			// This is a false positive. If the heuristics response, baseline response, and injected response all have the same response content
 			// It is not an indication of vulnerable functionality
@@ -103,40 +178,156 @@ func (r *Rule) evaluateContent(responseContent string, heuristicsResponse Respon
 		}
 	}
 
-	for _, content := range r.Expectation.Contents {
+	if !r.Expectation.contentMatches(responseContent) {
+		return false
+	}
+
+	if !heuristicExpected {
+		return true
+	}
+
+	if heuristicsResponse.Body == baselineResponse.Body {
+		// This is a false positive. If the heuristics response, baseline response, and injected response all have the same response content
+		// It is not an indication of vulnerable functionality
+		if baselineResponse.Body == responseContent {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Expand token templates (such as [[canary]]) in the content expectations with a task's token, so they only match
+// that task's responses. Regexes with token templates are compiled again for each task
+func (e ExpectedResponse) withToken(token string) ExpectedResponse {
+	if token == "" {
+		return e
+	}
+
+	e.Contents = expandTokenTemplatesAll(e.Contents, token)
+	e.ContentsNot = expandTokenTemplatesAll(e.ContentsNot, token)
+
+	contentsRegex := make([]*regexp.Regexp, len(e.contentsRegex))
+	copy(contentsRegex, e.contentsRegex)
+	for i, pattern := range e.ContentsRegex {
+		if !usesTokenTemplates(pattern) {
+			continue
+		}
+		// The pattern was already compiled when the config was loaded, and the token is quoted, so this can't fail
+		if re, err := regexp.Compile(expandTokenTemplatesRegex(pattern, token)); err == nil {
+			contentsRegex[i] = re
+		}
+	}
+	e.contentsRegex = contentsRegex
+	return e
+}
+
+func expandTokenTemplatesAll(values []string, token string) []string {
+	if values == nil {
+		return nil
+	}
+	expanded := make([]string, len(values))
+	for i, value := range values {
+		expanded[i] = expandTokenTemplates(value, token)
+	}
+	return expanded
+}
+
+// Check whether any of the plain (case insensitive) or regex content expectations are found in the response body
+func (e *ExpectedResponse) contentMatches(responseContent string) bool {
+	for _, content := range e.Contents {
 		if strings.Contains(strings.ToLower(responseContent), strings.ToLower(content)) {
-			if !heuristicExpected {
-				return true
+			return true
+		}
+	}
+
+	for _, re := range e.contentsRegex {
+		if re.MatchString(responseContent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the start and end offsets of every plain and regex content expectation match within the response body
+func (e *ExpectedResponse) contentMatchRanges(responseContent string) [][]int {
+	var ranges [][]int
+	lowerContent := strings.ToLower(responseContent)
+	for _, content := range e.Contents {
+		if content == "" {
+			continue
+		}
+		lowerExpected := strings.ToLower(content)
+		for offset := 0; ; {
+			index := strings.Index(lowerContent[offset:], lowerExpected)
+			if index == -1 {
+				break
 			}
+			ranges = append(ranges, []int{offset + index, offset + index + len(lowerExpected)})
+			offset += index + len(lowerExpected)
+		}
+	}
 
-			if heuristicsResponse.Body == baselineResponse.Body {
-				// This is a false positive. If the heuristics response, baseline response, and injected response all have the same response content
-				// It is not an indication of vulnerable functionality
-				if baselineResponse.Body == responseContent {
-					return false
-				}
-				return true
+	for _, re := range e.contentsRegex {
+		for _, match := range re.FindAllStringIndex(responseContent, -1) {
+			if match[1] > match[0] {
+				ranges = append(ranges, match)
 			}
 		}
 	}
-	return false
+	return ranges
+}
+
+func (r *Rule) evaluateContentNot(responseContent string) bool {
+	for _, content := range r.Expectation.ContentsNot {
+		if strings.Contains(strings.ToLower(responseContent), strings.ToLower(content)) {
+			return false
+		}
+	}
+	return true
 }
 
 func (r *Rule) evaluateHeaders(responseHeaders http.Header, heuristicsResponse Response, baselineResponse Response, heuristicExpected bool) bool {
-	for header, value := range r.Expectation.Headers {
+	if !r.Expectation.headersMatch(responseHeaders) {
+		return false
+	}
+
+	if !heuristicExpected {
+		return true
+	}
+
+	return reflect.DeepEqual(heuristicsResponse.Headers, baselineResponse.Headers)
+}
+
+// Check whether any of the plain (case insensitive contains) or regex header expectations match the response headers
+func (e *ExpectedResponse) headersMatch(responseHeaders http.Header) bool {
+	for header, value := range e.Headers {
 		if strings.Contains(strings.ToLower(responseHeaders.Get(header)), strings.ToLower(value)) {
-			if !heuristicExpected {
-				return true
-			}
+			return true
+		}
+	}
 
-			if reflect.DeepEqual(heuristicsResponse.Headers, baselineResponse.Headers) {
-				return true
-			}
+	for header, re := range e.headersRegex {
+		// Only match against headers that are actually present, so patterns such as ".*" don't match missing headers
+		if _, ok := responseHeaders[http.CanonicalHeaderKey(header)]; !ok {
+			continue
+		}
+		if re.MatchString(responseHeaders.Get(header)) {
+			return true
 		}
 	}
 	return false
 }
 
+func (r *Rule) evaluateHeadersAbsent(responseHeaders http.Header) bool {
+	for _, header := range r.Expectation.HeadersAbsent {
+		if _, ok := responseHeaders[http.CanonicalHeaderKey(header)]; ok {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *Rule) evaluateStatusCode(responseCode int, heuristicsResponse Response, baselineResponse Response, heuristicExpected bool) bool {
 	if heuristicExpected && len(r.Expectation.Codes) == 0 {
 		if heuristicsResponse.StatusCode == baselineResponse.StatusCode {
@@ -173,6 +364,42 @@ func (r *Rule) evaluateStatusCode(responseCode int, heuristicsResponse Response,
 	return false
 }
 
+func (r *Rule) evaluateStatusCodeNot(responseCode int) bool {
+	for _, code := range r.Expectation.CodesNot {
+		statusCode, err := strconv.Atoi(code)
+		if err != nil {
+			continue
+		}
+
+		if statusCode == responseCode {
+			return false
+		}
+	}
+	return true
+}
+
+// Unlike other categories, every response time expectation must hold so they can be used to define a range
+func (r *Rule) evaluateResponseTime(duration time.Duration) bool {
+	for _, expectation := range r.Expectation.times {
+		var matched bool
+		switch expectation.operator {
+		case ">":
+			matched = duration > expectation.duration
+		case "<":
+			matched = duration < expectation.duration
+		case "<=":
+			matched = duration <= expectation.duration
+		default:
+			matched = duration >= expectation.duration
+		}
+
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *Rule) evaluateContentLength(responseLength int, heuristicsResponse Response, baselineResponse Response, heuristicExpected bool) bool {
 	if heuristicExpected && len(r.Expectation.Lengths) == 0 {
 		if heuristicsMatch := isLengthWithinTenPercent(heuristicsResponse.ContentLength, baselineResponse.ContentLength); heuristicsMatch {
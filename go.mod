@@ -7,4 +7,5 @@ require (
 	github.com/PuerkitoBio/goquery v1.5.1 // indirect
 	github.com/fatih/color v1.9.0
 	github.com/spf13/viper v1.6.2
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A single location within a request which can be injected into, one at a time
+type injectionPoint struct {
+	Location      string
+	Name          string
+	OriginalValue string
+	inject        func(value string) Request
+	// Only set for JSON body leaves, to replace the leaf with any JSON value (i.e. changing its type)
+	injectJson func(value interface{}) Request
+}
+
+// Rules inject into the query string and body unless they define their own injection points
+var defaultInjectionPoints = []string{"query", "body"}
+
+// Get the injection points for each of a rule's locations, which are query, body, path, path:append, header:<name>
+// or cookie:<name>. A name of * injects into every header or cookie sent with the request
+func getInjectionPoints(request Request, locations []string) ([]injectionPoint, error) {
+	if len(locations) == 0 {
+		locations = defaultInjectionPoints
+	}
+
+	var points []injectionPoint
+	for _, location := range locations {
+		kind, name := splitInjectionPoint(location)
+
+		var locationPoints []injectionPoint
+		var err error
+		switch kind {
+		case "query":
+			locationPoints, err = queryInjectionPoints(request)
+		case "body":
+			locationPoints, err = bodyInjectionPoints(request)
+		case "path":
+			locationPoints, err = pathInjectionPoints(request, name == "append")
+		case "header":
+			locationPoints = headerInjectionPoints(request, name)
+		case "cookie":
+			locationPoints = cookieInjectionPoints(request, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, locationPoints...)
+	}
+	return points, nil
+}
+
+// Get the injection points declared by the request's OpenAPI operation that aren't already in points
+func declaredInjectionPoints(request Request, points []injectionPoint) ([]injectionPoint, error) {
+	var declaredPoints []injectionPoint
+	for _, location := range request.declaredPoints {
+		kind, name := splitInjectionPoint(location)
+
+		var locationPoints []injectionPoint
+		switch kind {
+		case "path":
+			pathPoints, err := pathInjectionPoints(request, false)
+			if err != nil {
+				return nil, err
+			}
+			for _, point := range pathPoints {
+				if point.Name == name {
+					locationPoints = append(locationPoints, point)
+				}
+			}
+		case "header":
+			locationPoints = headerInjectionPoints(request, name)
+		case "cookie":
+			locationPoints = cookieInjectionPoints(request, name)
+		}
+
+		for _, point := range locationPoints {
+			if !hasInjectionPoint(points, point) && !hasInjectionPoint(declaredPoints, point) {
+				declaredPoints = append(declaredPoints, point)
+			}
+		}
+	}
+	return declaredPoints, nil
+}
+
+func hasInjectionPoint(points []injectionPoint, point injectionPoint) bool {
+	for _, p := range points {
+		if p.Location == point.Location && p.Name == point.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func splitInjectionPoint(location string) (string, string) {
+	parts := strings.SplitN(location, ":", 2)
+	kind := strings.ToLower(strings.TrimSpace(parts[0]))
+	if len(parts) == 1 {
+		return kind, ""
+	}
+	return kind, strings.TrimSpace(parts[1])
+}
+
+func validateInjectionPoint(location string) error {
+	kind, name := splitInjectionPoint(location)
+	switch kind {
+	case "query", "body":
+		if name != "" {
+			return fmt.Errorf("injection point %q does not take a name", location)
+		}
+	case "path":
+		if name != "" && name != "append" {
+			return fmt.Errorf("injection point %q is not supported (expected path or path:append)", location)
+		}
+	case "header", "cookie":
+		if name == "" {
+			return fmt.Errorf("injection point %q requires a name (or *), i.e. %v:X-Forwarded-Host", location, kind)
+		}
+	default:
+		return fmt.Errorf("unknown injection point %q (expected query, body, path, path:append, header:<name> or cookie:<name>)", location)
+	}
+	return nil
+}
+
+func bodyInjectionPoints(request Request) ([]injectionPoint, error) {
+	if !methodHasBody(request.Method) || request.Body == "" {
+		return nil, nil
+	}
+
+	if isJsonBody(request) {
+		return jsonInjectionPoints(request)
+	}
+	return formInjectionPoints(request)
+}
+
+func queryInjectionPoints(request Request) ([]injectionPoint, error) {
+	u, err := url.Parse(request.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	// If query strings can't be parsed, set query strings as empty
+	queryStrings, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []injectionPoint
+	for _, param := range sortedParams(queryStrings) {
+		param := param
+		points = append(points, injectionPoint{
+			Location:      "query",
+			Name:          param,
+			OriginalValue: queryStrings.Get(param),
+			inject: func(value string) Request {
+				injectedUrl := *u
+				injectedUrl.RawQuery = encodeParams(withParam(queryStrings, param, value))
+				injected := request
+				injected.Url = injectedUrl.String()
+				return injected
+			},
+		})
+	}
+	return points, nil
+}
+
+func formInjectionPoints(request Request) ([]injectionPoint, error) {
+	bodyParams, err := url.ParseQuery(request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []injectionPoint
+	for _, param := range sortedParams(bodyParams) {
+		param := param
+		points = append(points, injectionPoint{
+			Location:      "body",
+			Name:          param,
+			OriginalValue: bodyParams.Get(param),
+			inject: func(value string) Request {
+				injected := request
+				injected.Body = encodeParams(withParam(bodyParams, param, value))
+				return injected
+			},
+		})
+	}
+	return points, nil
+}
+
+// Every leaf (string, number, bool or null) of a JSON body is an injection point, including those within nested
+// objects and arrays. Leaves are named by their path, such as user.addresses[0].city
+func jsonInjectionPoints(request Request) ([]injectionPoint, error) {
+	root, err := decodeJson(request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []injectionPoint
+	for _, leaf := range jsonLeaves(root, nil) {
+		leaf := leaf
+		injectJson := func(value interface{}) Request {
+			// Decode the body again for each injection, as setting the leaf modifies it in place
+			injectedRoot, _ := decodeJson(request.Body)
+			body, err := encodeJson(setJsonPath(injectedRoot, leaf.path, value))
+			if err != nil && opts.Debug {
+				printRed(os.Stderr, "error encoding JSON body for %v: %v\n", request.Url, err)
+			}
+			injected := request
+			injected.Body = body
+			return injected
+		}
+
+		points = append(points, injectionPoint{
+			Location:      "json",
+			Name:          formatJsonPath(leaf.path),
+			OriginalValue: leaf.value,
+			inject: func(value string) Request {
+				return injectJson(value)
+			},
+			injectJson: injectJson,
+		})
+	}
+	return points, nil
+}
+
+// Each path segment is injected one at a time, named by its position (starting at 1). When appending, a new segment
+// is added to the end of the path instead
+func pathInjectionPoints(request Request, appendSegment bool) ([]injectionPoint, error) {
+	u, err := url.Parse(request.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	escapedPath := u.EscapedPath()
+	trailingSlash := len(escapedPath) > 1 && strings.HasSuffix(escapedPath, "/")
+	var segments []string
+	if trimmed := strings.Trim(escapedPath, "/"); trimmed != "" {
+		segments = strings.Split(trimmed, "/")
+	}
+
+	inject := func(index int, value string) Request {
+		injectedSegments := append([]string(nil), segments...)
+		if index == len(segments) {
+			injectedSegments = append(injectedSegments, "")
+		}
+		// Values are path escaped (which includes /), unless requests should be sent decoded
+		if opts.DecodedParams {
+			injectedSegments[index] = value
+		} else {
+			injectedSegments[index] = url.PathEscape(value)
+		}
+
+		injectedUrl := (&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host}).String() + "/" + strings.Join(injectedSegments, "/")
+		if trailingSlash && index < len(segments) {
+			injectedUrl += "/"
+		}
+		if u.RawQuery != "" {
+			injectedUrl += "?" + u.RawQuery
+		}
+		injected := request
+		injected.Url = injectedUrl
+		return injected
+	}
+
+	if appendSegment {
+		return []injectionPoint{{
+			Location: "path",
+			Name:     strconv.Itoa(len(segments) + 1),
+			inject: func(value string) Request {
+				return inject(len(segments), value)
+			},
+		}}, nil
+	}
+
+	var points []injectionPoint
+	for index, segment := range segments {
+		index := index
+		originalValue, err := url.PathUnescape(segment)
+		if err != nil {
+			originalValue = segment
+		}
+		points = append(points, injectionPoint{
+			Location:      "path",
+			Name:          strconv.Itoa(index + 1),
+			OriginalValue: originalValue,
+			inject: func(value string) Request {
+				return inject(index, value)
+			},
+		})
+	}
+	return points, nil
+}
+
+// Normalise path segments that are usually identifiers, so paths such as /users/1 and /users/2 are considered the same
+func normalisePath(escapedPath string) string {
+	segments := strings.Split(escapedPath, "/")
+	for index, segment := range segments {
+		if numericSegmentRegex.MatchString(segment) {
+			segments[index] = "{int}"
+		} else if uuidSegmentRegex.MatchString(segment) {
+			segments[index] = "{uuid}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+var numericSegmentRegex = regexp.MustCompile(`^[0-9]+$`)
+var uuidSegmentRegex = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Headers are injected one at a time, with their original value being the value sent in the request (from the input
+// or -H), or empty if the header isn't sent. Host is always sent, so its original value defaults to the URL's host
+func headerInjectionPoints(request Request, name string) []injectionPoint {
+	headers := make(map[string]string)
+	if u, err := url.Parse(request.Url); err == nil && strings.EqualFold(name, "Host") {
+		headers["Host"] = u.Host
+	}
+	for header, value := range config.Headers {
+		headers[http.CanonicalHeaderKey(header)] = value
+	}
+	for header, value := range request.Headers {
+		headers[http.CanonicalHeaderKey(header)] = value
+	}
+	// Cookies are injected individually with cookie injection points instead
+	delete(headers, "Cookie")
+
+	var names []string
+	if name == "*" {
+		for header := range headers {
+			names = append(names, header)
+		}
+		sort.Strings(names)
+	} else {
+		names = []string{http.CanonicalHeaderKey(name)}
+	}
+
+	var points []injectionPoint
+	for _, header := range names {
+		header := header
+		points = append(points, injectionPoint{
+			Location:      "header",
+			Name:          header,
+			OriginalValue: headers[header],
+			inject: func(value string) Request {
+				injected := request
+				injected.Headers = request.withHeader(header, value)
+				return injected
+			},
+		})
+	}
+	return points
+}
+
+// Cookies are taken from the request's own Cookie header if it has one, otherwise from -cookies. Named cookies that
+// aren't sent are added to the request when injected
+func cookieInjectionPoints(request Request, name string) []injectionPoint {
+	rawCookies := request.header("Cookie")
+	if rawCookies == "" {
+		rawCookies = config.Cookies
+	}
+	cookies := parseCookies(rawCookies)
+
+	var indexes []int
+	if name == "*" {
+		for index := range cookies {
+			indexes = append(indexes, index)
+		}
+	} else {
+		index := -1
+		for i, cookie := range cookies {
+			if cookie.name == name {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			cookies = append(cookies, cookieValue{name: name})
+			index = len(cookies) - 1
+		}
+		indexes = []int{index}
+	}
+
+	var points []injectionPoint
+	for _, index := range indexes {
+		index := index
+		points = append(points, injectionPoint{
+			Location:      "cookie",
+			Name:          cookies[index].name,
+			OriginalValue: cookies[index].value,
+			inject: func(value string) Request {
+				injectedCookies := append([]cookieValue(nil), cookies...)
+				injectedCookies[index].value = value
+				injected := request
+				injected.Headers = request.withHeader("Cookie", formatCookies(injectedCookies))
+				return injected
+			},
+		})
+	}
+	return points
+}
+
+type cookieValue struct {
+	name  string
+	value string
+}
+
+// Cookies are kept in the order they're provided in, and values are kept as-is rather than being decoded
+func parseCookies(rawCookies string) []cookieValue {
+	var cookies []cookieValue
+	for _, rawCookie := range strings.Split(rawCookies, ";") {
+		rawCookie = strings.TrimSpace(rawCookie)
+		if rawCookie == "" {
+			continue
+		}
+		parts := strings.SplitN(rawCookie, "=", 2)
+		cookie := cookieValue{name: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			cookie.value = parts[1]
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies
+}
+
+func formatCookies(cookies []cookieValue) string {
+	rawCookies := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		rawCookies = append(rawCookies, cookie.name+"="+cookie.value)
+	}
+	return strings.Join(rawCookies, "; ")
+}
+
+type jsonLeaf struct {
+	path  []interface{}
+	value string
+}
+
+func jsonLeaves(node interface{}, path []interface{}) []jsonLeaf {
+	var leaves []jsonLeaf
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(value) {
+			leaves = append(leaves, jsonLeaves(value[key], appendPath(path, key))...)
+		}
+	case []interface{}:
+		for index, item := range value {
+			leaves = append(leaves, jsonLeaves(item, appendPath(path, index))...)
+		}
+	case string:
+		leaves = append(leaves, jsonLeaf{path: path, value: value})
+	case nil:
+		leaves = append(leaves, jsonLeaf{path: path, value: "null"})
+	default:
+		leaves = append(leaves, jsonLeaf{path: path, value: fmt.Sprint(value)})
+	}
+	return leaves
+}
+
+// Copy the path before appending, so sibling leaves don't share the same backing array
+func appendPath(path []interface{}, element interface{}) []interface{} {
+	return append(append([]interface{}(nil), path...), element)
+}
+
+func setJsonPath(node interface{}, path []interface{}, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	switch element := path[0].(type) {
+	case string:
+		object := node.(map[string]interface{})
+		object[element] = setJsonPath(object[element], path[1:], value)
+	case int:
+		array := node.([]interface{})
+		array[element] = setJsonPath(array[element], path[1:], value)
+	}
+	return node
+}
+
+func formatJsonPath(path []interface{}) string {
+	var name strings.Builder
+	for _, element := range path {
+		switch element := element.(type) {
+		case string:
+			if name.Len() > 0 {
+				name.WriteString(".")
+			}
+			name.WriteString(element)
+		case int:
+			name.WriteString(fmt.Sprintf("[%d]", element))
+		}
+	}
+	return name.String()
+}
+
+func isJsonBody(request Request) bool {
+	contentType := strings.ToLower(request.header("Content-Type"))
+	if contentType != "" {
+		return strings.Contains(contentType, "json")
+	}
+
+	body := strings.TrimSpace(request.Body)
+	return (strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[")) && json.Valid([]byte(body))
+}
+
+// Numbers are decoded as json.Number so they're encoded exactly as they were provided
+func decodeJson(body string) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+// HTML characters aren't escaped, as that would change payloads such as "><h2>asd</h2>
+func encodeJson(value interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// Get the names of the parameters within a request body, which are the leaf paths for JSON bodies
+func bodyParamNames(request Request) []string {
+	if isJsonBody(request) {
+		root, err := decodeJson(request.Body)
+		if err != nil {
+			return nil
+		}
+		var names []string
+		for _, leaf := range jsonLeaves(root, nil) {
+			names = append(names, formatJsonPath(leaf.path))
+		}
+		return names
+	}
+
+	bodyParams, _ := url.ParseQuery(request.Body)
+	return sortedParams(bodyParams)
+}
+
+// Default the Content-Type of requests that have a body but don't specify one, based on the body's contents
+func withDefaultContentType(request Request) Request {
+	if request.Body == "" || request.header("Content-Type") != "" {
+		return request
+	}
+
+	if isJsonBody(request) {
+		request.Headers = request.withHeader("Content-Type", "application/json")
+	} else {
+		request.Headers = request.withHeader("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return request
+}
+
+// Convert a request to the rule's method. Form body parameters are moved into the query string for methods
+// without a body, and the query string is moved into a form body for methods with one (if there isn't a body already)
+func withMethod(request Request, method string) (Request, error) {
+	if method == "" || method == request.Method {
+		return request, nil
+	}
+
+	u, err := url.Parse(request.Url)
+	if err != nil {
+		return request, err
+	}
+
+	converted := request
+	converted.Method = method
+
+	if !methodHasBody(method) {
+		if request.Body != "" && !isJsonBody(request) {
+			if u.RawQuery != "" {
+				u.RawQuery += "&"
+			}
+			u.RawQuery += request.Body
+		}
+		u.ForceQuery = false
+		converted.Url = u.String()
+		converted.Body = ""
+		converted.Headers = request.withoutHeader("Content-Type")
+	} else if request.Body == "" && u.RawQuery != "" {
+		converted.Body = u.RawQuery
+		u.RawQuery = ""
+		converted.Url = u.String()
+		converted.Headers = request.withHeader("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return converted, nil
+}
+
+// Add a rule's extra params to the request, which are added to the body for methods that have one
+func withExtraParams(request Request, extraParams []string) (Request, error) {
+	if len(extraParams) == 0 {
+		return request, nil
+	}
+
+	if methodHasBody(request.Method) && isJsonBody(request) {
+		root, err := decodeJson(request.Body)
+		if err != nil {
+			return request, err
+		}
+		// Extra params can only be added to JSON objects
+		object, ok := root.(map[string]interface{})
+		if !ok {
+			return request, nil
+		}
+		for _, param := range extraParams {
+			if _, exists := object[param]; !exists {
+				object[param] = ""
+			}
+		}
+		request.Body, err = encodeJson(object)
+		return request, err
+	}
+
+	if methodHasBody(request.Method) {
+		bodyParams, err := url.ParseQuery(request.Body)
+		if err != nil {
+			return request, err
+		}
+		request.Body = encodeParams(withParamsAdded(bodyParams, extraParams))
+		return withDefaultContentType(request), nil
+	}
+
+	u, err := url.Parse(request.Url)
+	if err != nil {
+		return request, err
+	}
+	queryStrings, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return request, err
+	}
+	u.RawQuery = encodeParams(withParamsAdded(queryStrings, extraParams))
+	request.Url = u.String()
+	return request, nil
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func withParamsAdded(values url.Values, params []string) url.Values {
+	for _, param := range params {
+		if len(values[param]) == 0 {
+			values.Add(param, "")
+		}
+	}
+	return values
+}
+
+// Copy the parameters with the given param's value replaced. Only the first value is replaced if there's more
+// than one of the same param, so only one parameter is updated at a time
+func withParam(values url.Values, param string, value string) url.Values {
+	injected := make(url.Values, len(values))
+	for key, vals := range values {
+		injected[key] = append([]string(nil), vals...)
+	}
+	injected[param][0] = value
+	return injected
+}
+
+func encodeParams(values url.Values) string {
+	encoded, err := getInjectedQueryString(values)
+	if err != nil {
+		if opts.Debug {
+			printRed(os.Stderr, "Error decoding parameters: %v\n", err)
+		}
+		return values.Encode()
+	}
+	return encoded
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJsonInjectionPoints(t *testing.T) {
+	tests := []struct {
+		body           string
+		names          []string
+		originalValues []string
+	}{
+		{`{"b":{"d":[true,null,"y"],"c":1},"a":"x"}`, []string{"a", "b.c", "b.d[0]", "b.d[1]", "b.d[2]"}, []string{"x", "1", "true", "null", "y"}},
+		{`[{"id":"1"},{"id":2.50}]`, []string{"[0].id", "[1].id"}, []string{"1", "2.50"}},
+		{`{"a":[[1],{"b":""}]}`, []string{"a[0][0]", "a[1].b"}, []string{"1", ""}},
+		{`"x"`, []string{""}, []string{"x"}},
+		{`{"a":{},"b":[]}`, nil, nil},
+	}
+
+	for _, test := range tests {
+		points, err := jsonInjectionPoints(Request{Body: test.body})
+		if err != nil {
+			t.Errorf("jsonInjectionPoints(%q) returned error: %v", test.body, err)
+			continue
+		}
+		var names, originalValues []string
+		for _, point := range points {
+			names = append(names, point.Name)
+			originalValues = append(originalValues, point.OriginalValue)
+		}
+		if !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(originalValues, test.originalValues) {
+			t.Errorf("jsonInjectionPoints(%q) = %q, %q, want %q, %q", test.body, names, originalValues, test.names, test.originalValues)
+		}
+	}
+
+	if _, err := jsonInjectionPoints(Request{Body: `{"a":`}); err == nil {
+		t.Errorf("jsonInjectionPoints of an invalid body didn't return an error")
+	}
+}
+
+func TestJsonInjection(t *testing.T) {
+	tests := []struct {
+		body     string
+		point    string
+		value    interface{}
+		injected string
+	}{
+		{`{"a":"x","b":{"c":1.50}}`, "a", `"><h2>`, `{"a":"\"><h2>","b":{"c":1.50}}`},
+		{`{"a":"x","b":{"c":1.50}}`, "b.c", "1 OR 1=1", `{"a":"x","b":{"c":"1 OR 1=1"}}`},
+		{`{"a":[1,2]}`, "a[1]", "x", `{"a":[1,"x"]}`},
+		{`[{"id":1}]`, "[0].id", "x", `[{"id":"x"}]`},
+		{`"x"`, "", "y", `"y"`},
+		// Leaves can be replaced with any JSON value
+		{`{"user":"admin","pass":"x"}`, "pass", map[string]interface{}{"$ne": nil}, `{"pass":{"$ne":null},"user":"admin"}`},
+		{`{"a":"x"}`, "a", []interface{}{true}, `{"a":[true]}`},
+	}
+
+	for _, test := range tests {
+		points, err := jsonInjectionPoints(Request{Body: test.body})
+		if err != nil {
+			t.Fatalf("jsonInjectionPoints(%q) returned error: %v", test.body, err)
+		}
+
+		found := false
+		for _, point := range points {
+			if point.Name != test.point {
+				continue
+			}
+			found = true
+			var injected Request
+			if value, ok := test.value.(string); ok {
+				injected = point.inject(value)
+			} else {
+				injected = point.injectJson(test.value)
+			}
+			if injected.Body != test.injected {
+				t.Errorf("injecting %v into %q of %q = %q, want %q", test.value, test.point, test.body, injected.Body, test.injected)
+			}
+		}
+		if !found {
+			t.Errorf("%q has no injection point %q", test.body, test.point)
+		}
+	}
+}
+
+// Each injection starts from the original body, rather than one with earlier injections in it
+func TestJsonInjectionsAreIndependent(t *testing.T) {
+	points, err := jsonInjectionPoints(Request{Body: `{"a":"x","b":"y"}`})
+	if err != nil || len(points) != 2 {
+		t.Fatalf("jsonInjectionPoints returned %v points and error %v", len(points), err)
+	}
+	points[0].inject("1")
+	points[0].injectJson(false)
+	if injected := points[1].inject("2"); injected.Body != `{"a":"x","b":"2"}` {
+		t.Errorf("injecting into b after a = %q", injected.Body)
+	}
+}
+
+func TestFormatJsonPath(t *testing.T) {
+	tests := []struct {
+		path      []interface{}
+		formatted string
+	}{
+		{nil, ""},
+		{[]interface{}{"a"}, "a"},
+		{[]interface{}{"a", "b", 0, "c"}, "a.b[0].c"},
+		{[]interface{}{0, "x"}, "[0].x"},
+		{[]interface{}{"a", 1, 2}, "a[1][2]"},
+	}
+
+	for _, test := range tests {
+		if formatted := formatJsonPath(test.path); formatted != test.formatted {
+			t.Errorf("formatJsonPath(%v) = %q, want %q", test.path, formatted, test.formatted)
+		}
+	}
+}
+
+func TestPathInjectionPoints(t *testing.T) {
+	tests := []struct {
+		url            string
+		appendSegment  bool
+		names          []string
+		originalValues []string
+		injected       []string
+	}{
+		{"https://example.com/a/b?q=1", false, []string{"1", "2"}, []string{"a", "b"}, []string{"https://example.com/x%20y%2Fz/b?q=1", "https://example.com/a/x%20y%2Fz?q=1"}},
+		{"https://example.com/users/1/", false, []string{"1", "2"}, []string{"users", "1"}, []string{"https://example.com/x%20y%2Fz/1/", "https://example.com/users/x%20y%2Fz/"}},
+		{"https://user@example.com:8443/a%20b", false, []string{"1"}, []string{"a b"}, []string{"https://user@example.com:8443/x%20y%2Fz"}},
+		{"https://example.com/", false, nil, nil, nil},
+		{"https://example.com", false, nil, nil, nil},
+		// Appended segments are added after the last one, replacing any trailing slash
+		{"https://example.com/a/b/?q=1", true, []string{"3"}, []string{""}, []string{"https://example.com/a/b/x%20y%2Fz?q=1"}},
+		{"https://example.com/", true, []string{"1"}, []string{""}, []string{"https://example.com/x%20y%2Fz"}},
+	}
+
+	for _, test := range tests {
+		points, err := pathInjectionPoints(Request{Url: test.url}, test.appendSegment)
+		if err != nil {
+			t.Errorf("pathInjectionPoints(%q) returned error: %v", test.url, err)
+			continue
+		}
+		var names, originalValues, injected []string
+		for _, point := range points {
+			names = append(names, point.Name)
+			originalValues = append(originalValues, point.OriginalValue)
+			injected = append(injected, point.inject("x y/z").Url)
+		}
+		if !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(originalValues, test.originalValues) {
+			t.Errorf("pathInjectionPoints(%q, %v) = %q, %q, want %q, %q", test.url, test.appendSegment, names, originalValues, test.names, test.originalValues)
+		}
+		if !reflect.DeepEqual(injected, test.injected) {
+			t.Errorf("pathInjectionPoints(%q, %v) injected %q, want %q", test.url, test.appendSegment, injected, test.injected)
+		}
+	}
+}
+
+func TestNormalisePath(t *testing.T) {
+	tests := map[string]string{
+		"":                 "",
+		"/":                "/",
+		"/users/123/posts": "/users/{int}/posts",
+		"/users/123/":      "/users/{int}/",
+		"/v1/users":        "/v1/users",
+		"/a/1/b/22":        "/a/{int}/b/{int}",
+		"/items/123abc":    "/items/123abc",
+		"/files/-1":        "/files/-1",
+		"/orders/3F2504E0-4F89-11D3-9A0C-0305E82C3301":  "/orders/{uuid}",
+		"/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301x": "/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301x",
+	}
+
+	for path, want := range tests {
+		if normalised := normalisePath(path); normalised != want {
+			t.Errorf("normalisePath(%q) = %q, want %q", path, normalised, want)
+		}
+	}
+}
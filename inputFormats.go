@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var inputFormats = []string{"urls", "burp", "har", "openapi"}
+
+// Headers which are set by the HTTP client when a request is sent, so they aren't kept from captured requests.
+// Accept-Encoding is also left to the client, so compressed responses are decompressed before being evaluated
+var ignoredHeaders = []string{"host", "content-length", "connection", "accept-encoding", "transfer-encoding", "keep-alive",
+	"proxy-connection", "upgrade", "te"}
+
+// An item from Burp's "Save items" XML export
+type burpItem struct {
+	Url     string `xml:"url"`
+	Request struct {
+		Base64 bool   `xml:"base64,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"request"`
+}
+
+// Read each item of a Burp XML export as it's decoded, rather than loading the whole export into memory
+func readBurpRequests(input io.Reader, emit func(Request)) error {
+	decoder := xml.NewDecoder(input)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "item" {
+			continue
+		}
+
+		var item burpItem
+		if err := decoder.DecodeElement(&item, &start); err != nil {
+			return err
+		}
+
+		request, err := item.toRequest()
+		if err != nil {
+			if opts.Debug {
+				printRed(os.Stderr, "error parsing Burp item %v: %v\n", item.Url, err)
+			}
+			continue
+		}
+		emit(request)
+	}
+}
+
+func (item burpItem) toRequest() (Request, error) {
+	raw := item.Request.Value
+	if item.Request.Base64 {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+		if err != nil {
+			return Request{}, err
+		}
+		raw = string(decoded)
+	}
+
+	// Burp's URL is used as the request's target may only be a path, and the Host header doesn't include the scheme
+	return parseRawRequest(raw, item.Url, "https")
+}
+
+type harArchive struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method   string         `json:"method"`
+				Url      string         `json:"url"`
+				Headers  []harNameValue `json:"headers"`
+				Cookies  []harNameValue `json:"cookies"`
+				PostData *harPostData   `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []harNameValue `json:"params"`
+}
+
+// HAR files are a single JSON document, so they're decoded in one go
+func readHarRequests(input io.Reader, emit func(Request)) error {
+	var archive harArchive
+	if err := json.NewDecoder(input).Decode(&archive); err != nil {
+		return fmt.Errorf("invalid HAR file: %v", err)
+	}
+
+	for _, entry := range archive.Log.Entries {
+		harRequest := entry.Request
+		request := Request{Method: strings.ToUpper(harRequest.Method), Url: harRequest.Url, Headers: make(map[string]string)}
+		if request.Method == "" {
+			request.Method = "GET"
+		}
+
+		for _, header := range harRequest.Headers {
+			addCapturedHeader(request.Headers, header.Name, header.Value)
+		}
+
+		// Cookies are usually in the headers as well, but not always
+		if request.header("Cookie") == "" && len(harRequest.Cookies) > 0 {
+			var cookies []string
+			for _, cookie := range harRequest.Cookies {
+				cookies = append(cookies, cookie.Name+"="+cookie.Value)
+			}
+			request.Headers["Cookie"] = strings.Join(cookies, "; ")
+		}
+
+		if postData := harRequest.PostData; postData != nil {
+			request.Body = postData.Text
+			// Some browsers only include the parsed form parameters
+			if request.Body == "" && len(postData.Params) > 0 {
+				values := url.Values{}
+				for _, param := range postData.Params {
+					values.Add(param.Name, param.Value)
+				}
+				request.Body = values.Encode()
+			}
+			if request.header("Content-Type") == "" && postData.MimeType != "" {
+				request.Headers["Content-Type"] = postData.MimeType
+			}
+		}
+		emit(request)
+	}
+	return nil
+}
+
+// Parse a raw HTTP request, such as one copied from Burp. The target is resolved against the base URL, or if there
+// isn't one, the Host header (using the given scheme)
+func parseRawRequest(raw string, baseUrl string, scheme string) (Request, error) {
+	request := Request{Headers: make(map[string]string)}
+
+	reader := bufio.NewReader(strings.NewReader(raw))
+	requestLine, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return request, err
+	}
+
+	parts := strings.Fields(requestLine)
+	if len(parts) < 2 || !isHttpMethod(parts[0]) {
+		return request, fmt.Errorf("invalid request line %q", strings.TrimSpace(requestLine))
+	}
+	request.Method = parts[0]
+	target := parts[1]
+
+	host := ""
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return request, fmt.Errorf("invalid header %q", line)
+		}
+		name, value := strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:])
+		if strings.EqualFold(name, "Host") {
+			host = value
+		}
+		addCapturedHeader(request.Headers, name, value)
+
+		if err != nil {
+			break
+		}
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return request, err
+	}
+	request.Body = string(body)
+
+	if baseUrl == "" {
+		if host == "" {
+			return request, errors.New("request has no Host header")
+		}
+		baseUrl = scheme + "://" + host
+	}
+
+	base, err := url.Parse(baseUrl)
+	if err != nil {
+		return request, err
+	}
+	targetUrl, err := base.Parse(target)
+	if err != nil {
+		return request, err
+	}
+	request.Url = targetUrl.String()
+	return request, nil
+}
+
+// Keep a header from a captured request, unless it's one the HTTP client sets itself
+func addCapturedHeader(headers map[string]string, name string, value string) {
+	// HTTP/2 pseudo headers, such as :authority
+	if strings.HasPrefix(name, ":") || containsString(ignoredHeaders, strings.ToLower(name)) {
+		return
+	}
+
+	for existing := range headers {
+		if strings.EqualFold(existing, name) {
+			separator := ", "
+			if strings.EqualFold(name, "Cookie") {
+				separator = "; "
+			}
+			headers[existing] += separator + value
+			return
+		}
+	}
+	headers[name] = value
+}
@@ -1,22 +1,35 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/fatih/color"
 	"net/http"
-	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Rule struct {
-	Description string           `mapstructure:"description"`
-	Injections  []string         `mapstructure:"injections"`
-	ExtraParams []string         `mapstructure:"extraParams"`
-	Expectation ExpectedResponse `mapstructure:"expectation"`
-	Heuristics  HeuristicsRule   `mapstructure:"heuristics"`
+	Description     string           `mapstructure:"description"`
+	Severity        string           `mapstructure:"severity"`
+	Tags            []string         `mapstructure:"tags"`
+	Method          string           `mapstructure:"method"`
+	Injections      []string         `mapstructure:"injections"`
+	JsonInjections  []string         `mapstructure:"jsonInjections"`
+	InjectionPoints []string         `mapstructure:"injectionPoints"`
+	ExtraParams     []string         `mapstructure:"extraParams"`
+	Encoders        []string         `mapstructure:"encoders"`
+	Expectation     ExpectedResponse `mapstructure:"expectation"`
+	Heuristics      HeuristicsRule   `mapstructure:"heuristics"`
+	Condition       string           `mapstructure:"condition"`
+	Timing          TimingRule       `mapstructure:"timing"`
+
+	// Compiled version of Condition, populated when the config is loaded
+	condition *Condition
 }
 
 type HeuristicsRule struct {
@@ -24,17 +37,61 @@ type HeuristicsRule struct {
 	BaselineMatches []string `mapstructure:"baselineMatches"`
 }
 
+type TimingRule struct {
+	Delay       int `mapstructure:"delay"`
+	VerifyDelay int `mapstructure:"verifyDelay"`
+}
+
 type ExpectedResponse struct {
-	Contents []string          `mapstructure:"responseContents"`
-	Codes    []string          `mapstructure:"responseCodes"`
-	Headers  map[string]string `mapstructure:"responseHeaders"`
-	Lengths  []string          `mapstructure:"responseLength"`
+	Contents      []string               `mapstructure:"responseContents"`
+	ContentsRegex []string               `mapstructure:"responseContentsRegex"`
+	ContentsNot   []string               `mapstructure:"responseContentsNot"`
+	Codes         []string               `mapstructure:"responseCodes"`
+	CodesNot      []string               `mapstructure:"responseCodesNot"`
+	Headers       map[string]string      `mapstructure:"responseHeaders"`
+	HeadersRegex  map[string]string      `mapstructure:"responseHeadersRegex"`
+	HeadersAbsent []string               `mapstructure:"responseHeadersAbsent"`
+	Lengths       []string               `mapstructure:"responseLength"`
+	Times         []string               `mapstructure:"responseTime"`
+	Reflection    *ReflectionExpectation `mapstructure:"reflection"`
+
+	// Compiled versions of the regex and time expectations, populated when the config is loaded
+	contentsRegex []*regexp.Regexp
+	headersRegex  map[string]*regexp.Regexp
+	times         []timeExpectation
 }
 
-type UrlInjection struct {
-	BaselineUrl   string
-	InjectedUrl   string
-	HeuristicsUrl string
+type timeExpectation struct {
+	operator string
+	duration time.Duration
+}
+
+type Request struct {
+	Method  string            `json:"method"`
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+
+	// Raw requests with injection markers are injected by replacing the marked regions of the original raw request
+	markedRaw string
+	// Injection points for the path, header and cookie parameters declared by an OpenAPI document, i.e. path:2 (the
+	// second path segment) or header:X-Api-Version
+	declaredPoints []string
+}
+
+type RequestInjection struct {
+	Location   string
+	Parameter  string
+	Payload    string
+	Baseline   Request
+	Injected   Request
+	Heuristics Request
+	Verify     Request
+	// Unique to this injection, for payloads with token templates such as [[oob]]
+	Token string
+	// The encoder chain applied to the payload, if any, and the payload before it was encoded
+	Encoders         string
+	UnencodedPayload string
 }
 
 type Response struct {
@@ -42,37 +99,64 @@ type Response struct {
 	Body          string
 	Headers       http.Header
 	ContentLength int
+	Duration      time.Duration
+	// The headers that were actually sent with the request, including those added from -H and -cookies
+	RequestHeaders http.Header
 }
 
 type RuleEvaluation struct {
 	ChecksMatched  int
+	MatchedChecks  []string
 	SuccessMessage string
 	Successful     bool
+	// Reflections of the task's token that matched the reflection expectation
+	Reflections []Reflection
 }
 
 type EvaluationResult struct {
-	RuleName        string
-	RuleDescription string
-	InjectedUrl     string
+	RuleName                string       `json:"rule"`
+	RuleDescription         string       `json:"description"`
+	Severity                string       `json:"severity,omitempty"`
+	Tags                    []string     `json:"tags,omitempty"`
+	Location                string       `json:"location"`
+	Parameter               string       `json:"parameter"`
+	Payload                 string       `json:"payload"`
+	Encoders                string       `json:"encoders,omitempty"`
+	Method                  string       `json:"method"`
+	InjectedUrl             string       `json:"injectedUrl"`
+	InjectedBody            string       `json:"injectedBody,omitempty"`
+	BaselineUrl             string       `json:"baselineUrl"`
+	HeuristicsUrl           string       `json:"heuristicsUrl,omitempty"`
+	StatusCode              int          `json:"statusCode"`
+	BaselineStatusCode      int          `json:"baselineStatusCode,omitempty"`
+	HeuristicsStatusCode    int          `json:"heuristicsStatusCode,omitempty"`
+	ContentLength           int          `json:"contentLength"`
+	BaselineContentLength   int          `json:"baselineContentLength,omitempty"`
+	HeuristicsContentLength int          `json:"heuristicsContentLength,omitempty"`
+	MatchedChecks           []string     `json:"matchedChecks"`
+	Reflections             []Reflection `json:"reflections,omitempty"`
+	Timestamp               time.Time    `json:"timestamp"`
+	// The out-of-band interaction, for matches found by the OOB listeners
+	Interaction *OobInteraction `json:"interaction,omitempty"`
+	// Request and response evidence, only collected for HTML reports
+	Evidence *Evidence `json:"-"`
 }
 
 type Task struct {
-	UrlInjection UrlInjection
-	RuleData     Rule
-	RuleName     string
+	Injection RequestInjection
+	RuleData  Rule
+	RuleName  string
+	// The number of times the task has been retried after being throttled
+	Attempts int
 }
 
-var failedRequestsSent int
-var successfulRequestsSent int
 var config Config
 var opts CliOptions
 var evaluationResults []EvaluationResult
-var responseCache map[string]Response
 
 var printGreen = color.New(color.FgGreen).PrintfFunc()
 var printRed = color.New(color.FgRed).FprintfFunc()
 var printCyan = color.New(color.FgCyan).FprintfFunc()
-var startTime = time.Now()
 
 func main() {
 	err := verifyFlags(&opts)
@@ -87,124 +171,346 @@ func main() {
 		os.Exit(1)
 	}
 
-	urls, err := getUrlsFromFile()
-	if err != nil {
-		fmt.Println(err)
+	if err := openOutput(); err != nil {
+		fmt.Println("Failed opening output file:", err)
 		os.Exit(1)
 	}
 
+	if opts.StateFile != "" {
+		scanState, err = openState(opts.StateFile)
+		if err != nil {
+			fmt.Println("Failed opening state file:", err)
+			os.Exit(1)
+		}
+		if completed := len(scanState.completed); completed > 0 && !opts.SilentMode {
+			printCyan(os.Stderr, "Resuming scan, %v tasks were completed by previous runs\n", completed)
+		}
+	}
+	handleInterrupts()
+
 	// Create HTTP Transport and Client after parsing flags
-	createClient()
+	if err := createClient(); err != nil {
+		fmt.Println("Failed creating HTTP client:", err)
+		os.Exit(1)
+	}
+	baselineCache = newResponseCache(opts.CacheSize, time.Duration(opts.CacheTtl)*time.Second)
+	rateLimiter = newRateLimiter(opts.Rate, opts.HostRate, opts.HostConcurrency)
 
-	if !opts.SilentMode {
-		printCyan(os.Stderr, "There are %v unique URL/Query String combinations. Time to inject each query string, 1 at a time!\n", len(urls))
+	if opts.OobDomain != "" {
+		oobServer, err = startOobServer(opts.OobDomain, opts.OobHttp, opts.OobDns, opts.OobIp, time.Duration(opts.OobWait)*time.Second)
+		if err != nil {
+			fmt.Println("Failed starting out-of-band listeners:", err)
+			os.Exit(1)
+		}
 	}
 
+	// Requests are read from stdin as they arrive, so tasks can start before the input is complete
+	requests := make(chan Request)
+	go func() {
+		var err error
+		if opts.RequestFile != "" {
+			err = readRawRequestFile(opts.RequestFile, requests)
+		} else {
+			err = readRequests(os.Stdin, requests)
+		}
+		if err != nil {
+			printRed(os.Stderr, "error reading input: %v\n", err)
+		}
+		close(requests)
+	}()
+
 	tasks := make(chan Task)
 
 	var wg sync.WaitGroup
-
-	startTime := time.Now()
+	// Tasks are counted until they're complete, as throttled tasks are put back on the queue to be retried later
+	var pending sync.WaitGroup
 
 	for i := 0; i < opts.Concurrency; i++ {
 		wg.Add(1)
 		go func() {
 			for task := range tasks {
-				task.execute()
+				// Once interrupted, tasks that haven't been started yet are left for the next run
+				if isInterrupted() {
+					pending.Done()
+					continue
+				}
+				task.run(tasks, &pending)
 			}
 			wg.Done()
 		}()
 	}
 
-	for _, u := range urls {
-		for rule, ruleData := range config.Rules {
-			fullUrl, err := url.Parse(u)
-			// If URL can't be parsed, ignore and move on
-			if err != nil {
-				if opts.Debug {
-					printRed(os.Stderr, "[%v] error parsing URL or query parameters for %v\n", rule, u)
-				}
-				continue
-			}
+	// The number of tasks from the input that haven't already been completed by a previous run, and the number that
+	// have and are skipped
+	queuedTasks := 0
+	skippedTasks := 0
 
-			injectedUrls, err := getInjectedUrls(fullUrl, ruleData)
-			if err != nil {
-				if opts.Debug {
-					printRed(os.Stderr, "[%v] error parsing URL or query parameters for %v\n", rule, u)
+queueTasks:
+	for {
+		var request Request
+		select {
+		case r, ok := <-requests:
+			if !ok {
+				if !opts.SilentMode {
+					printCyan(os.Stderr, "Finished reading input, there are %v unique URL/Query String combinations\n", stats.inputsRead())
+					if opts.StateFile != "" {
+						printCyan(os.Stderr, "Skipped %v tasks from the input that were completed by previous runs\n", skippedTasks)
+					}
 				}
-				continue
+				break queueTasks
 			}
-			if injectedUrls == nil {
+			request = r
+		case <-interrupted:
+			break queueTasks
+		}
+
+		var requestTasks []Task
+		for _, task := range getTasks(request) {
+			if scanState.isComplete(task) {
+				skippedTasks += 1
 				continue
 			}
+			requestTasks = append(requestTasks, task)
+		}
+		queuedTasks += len(requestTasks)
 
-			for _, injectedUrl := range injectedUrls {
-				tasks <- Task{RuleName: rule, RuleData: ruleData, UrlInjection: injectedUrl}
+		for _, task := range requestTasks {
+			pending.Add(1)
+			select {
+			case tasks <- task:
+			case <-interrupted:
+				pending.Done()
+				break queueTasks
 			}
 		}
 	}
 
+	pending.Wait()
 	close(tasks)
 	wg.Wait()
 
-	secondsElapsed := time.Since(startTime).Seconds()
-	printCyan(os.Stderr, "Evaluations complete! %v successful requests sent (%v failed): %v requests per second\n", successfulRequestsSent, failedRequestsSent, int(float64(successfulRequestsSent)/secondsElapsed))
+	if oobServer != nil {
+		oobServer.wait(time.Duration(opts.OobWait) * time.Second)
+		oobServer.close()
+	}
+
+	if err := closeOutput(); err != nil {
+		printRed(os.Stderr, "error writing results to %v: %v\n", opts.OutputFile, err)
+	}
+
+	if err := scanState.close(); err != nil {
+		printRed(os.Stderr, "error writing state to %v: %v\n", opts.StateFile, err)
+	}
+
+	if !opts.SilentMode {
+		stats.printSummary(os.Stderr)
+	}
+
+	if hosts := rateLimiter.abandonedHosts(); len(hosts) > 0 {
+		printRed(os.Stderr, "%v host(s) were abandoned after throttling too many requests: %v\n", len(hosts), strings.Join(hosts, ", "))
+	}
+
+	successful, failed := stats.requestsSent()
+	if isInterrupted() {
+		// Only the input that has been read so far is known, as input is streamed
+		remaining := queuedTasks - scanState.completedByThisRun()
+		printCyan(os.Stderr, "Scan interrupted! %v successful requests sent (%v failed), %v tasks remain from the input read so far\n", successful, failed, remaining)
+		if opts.StateFile != "" {
+			printCyan(os.Stderr, "Run again with -state %v to resume the scan\n", opts.StateFile)
+		}
+		return
+	}
+	printCyan(os.Stderr, "Evaluations complete! %v successful requests sent (%v failed): %v requests per second\n", successful, failed, stats.requestsPerSecond())
 }
 
-func (t Task) execute() {
-	resp, err := sendRequest(t.UrlInjection.InjectedUrl)
-	if err != nil {
-		failedRequestsSent += 1
+// Get the tasks for every rule's injections into the request
+func getTasks(request Request) []Task {
+	var tasks []Task
+	for rule, ruleData := range config.Rules {
+		// If URL or parameters can't be parsed, ignore and move on
+		requestInjections, err := getInjectedRequests(request, ruleData)
+		if err != nil {
+			if opts.Debug {
+				printRed(os.Stderr, "[%v] error parsing URL or parameters for %v\n", rule, request)
+			}
+			continue
+		}
+
+		for _, requestInjection := range requestInjections {
+			tasks = append(tasks, Task{RuleName: rule, RuleData: ruleData, Injection: requestInjection})
+		}
+	}
+	return tasks
+}
+
+// Execute the task, putting it back on the queue if its host is throttling requests, to be retried once the host is
+// no longer paused
+func (t Task) run(tasks chan<- Task, pending *sync.WaitGroup) {
+	err := t.execute()
+
+	var throttledErr *ThrottledError
+	if errors.As(err, &throttledErr) && t.Attempts < config.Throttling.maxRetries {
+		t.Attempts += 1
 		if opts.Debug {
-			printRed(os.Stderr, "error sending HTTP request to %v: %v\n", t.UrlInjection.InjectedUrl, err)
+			printRed(os.Stderr, "[%v] %v, retrying %v\n", t.RuleName, err, t.Injection.Injected)
 		}
+		go func() {
+			select {
+			case <-time.After(time.Until(throttledErr.Until)):
+				tasks <- t
+			case <-interrupted:
+				pending.Done()
+			}
+		}()
 		return
 	}
-	successfulRequestsSent += 1
+
+	if err != nil {
+		stats.recordIncomplete(t.RuleName)
+		if opts.Debug {
+			printRed(os.Stderr, "[%v] task for %v could not be completed: %v\n", t.RuleName, t.Injection.Injected, err)
+		}
+	} else if err := scanState.complete(t); err != nil {
+		printRed(os.Stderr, "error writing state to %v: %v\n", opts.StateFile, err)
+	}
+	pending.Done()
+}
+
+// Errors are returned when the task couldn't be completed, as any of its requests failed. Rather than evaluating
+// against an empty response, these tasks are recorded as incomplete (or retried later, if they were throttled)
+func (t Task) execute() error {
+	if err := rateLimiter.available(t.Injection.Injected.hostname()); err != nil {
+		return err
+	}
+
+	if oobServer != nil && t.Injection.Token != "" {
+		oobServer.register(t)
+		defer oobServer.complete(t.Injection.Token)
+	}
+
+	// Token expectations only match this task's token, so they prove a reflection came from this exact request
+	t.RuleData.Expectation = t.RuleData.Expectation.withToken(t.Injection.Token)
+
+	resp, err := t.send(t.Injection.Injected)
+	if err != nil {
+		return err
+	}
 
 	heuristicsResponse := Response{}
 	baselineResponse := Response{}
 	if t.RuleData.Heuristics.Injection != "" {
-		// Check if the baseline URL has already been requested to avoid duplicate requests
-		if response, ok := responseCache[t.UrlInjection.BaselineUrl]; ok {
-			baselineResponse = response
-		} else {
-			baselineResponse, err = sendRequest(t.UrlInjection.BaselineUrl)
-			if err != nil {
-				failedRequestsSent += 1
-				if opts.Debug {
-					printRed(os.Stderr, "error sending HTTP request to %v: %v\n", t.UrlInjection.BaselineUrl, err)
-				}
-			}
-			successfulRequestsSent += 1
+		// The same baseline request is shared by every injection for a URL, so it's only sent once
+		baselineResponse, err = baselineCache.get(t.Injection.Baseline.cacheKey(), func() (Response, error) {
+			return t.send(t.Injection.Baseline)
+		})
+		if err != nil {
+			return fmt.Errorf("baseline request failed: %w", err)
 		}
-		heuristicsResponse, err = sendRequest(t.UrlInjection.HeuristicsUrl)
+
+		heuristicsResponse, err = t.send(t.Injection.Heuristics)
+		if err != nil {
+			return fmt.Errorf("heuristics request failed: %w", err)
+		}
+	}
+
+	ruleEvaluation := t.RuleData.evaluate(resp, t.Injection, t.RuleName, heuristicsResponse, baselineResponse)
+	if ruleEvaluation.Successful && t.RuleData.Timing.Delay > 0 {
+		verified, err := t.verifyTiming(resp)
 		if err != nil {
-			failedRequestsSent += 1
+			return fmt.Errorf("timing verification request failed: %w", err)
+		}
+		if !verified {
 			if opts.Debug {
-				printRed(os.Stderr, "error sending HTTP request to %v: %v\n", t.UrlInjection.HeuristicsUrl, err)
+				printRed(os.Stderr, "[%v] time based match for %v could not be verified, ignoring\n", t.RuleName, t.Injection.Injected)
 			}
+			return nil
 		}
-		successfulRequestsSent += 1
 	}
 
-	// Send an update every 1,000 requests
-	if !opts.SilentMode {
-		totalRequestsSent := successfulRequestsSent + failedRequestsSent
-		if totalRequestsSent%1000 == 0 {
-			secondsElapsed := time.Since(startTime).Seconds()
-			fmt.Fprintf(os.Stderr, "%v requests sent (%v failed): %v requests per second\n", totalRequestsSent, failedRequestsSent, int(float64(successfulRequestsSent)/secondsElapsed))
+	if ruleEvaluation.Successful {
+		result := t.newResult()
+		result.StatusCode = resp.StatusCode
+		result.ContentLength = resp.ContentLength
+		result.MatchedChecks = ruleEvaluation.MatchedChecks
+		result.Reflections = ruleEvaluation.Reflections
+		if t.RuleData.Heuristics.Injection != "" {
+			result.HeuristicsUrl = t.Injection.Heuristics.Url
+			result.BaselineStatusCode = baselineResponse.StatusCode
+			result.BaselineContentLength = baselineResponse.ContentLength
+			result.HeuristicsStatusCode = heuristicsResponse.StatusCode
+			result.HeuristicsContentLength = heuristicsResponse.ContentLength
 		}
+
+		if opts.OutputFormat == "html" {
+			result.Evidence = newEvidence(t, resp, baselineResponse, heuristicsResponse)
+		}
+
+		reportMatch(result, t.Injection.Injected, ruleEvaluation.SuccessMessage)
+	}
+	return nil
+}
+
+func (t Task) newResult() EvaluationResult {
+	return EvaluationResult{
+		RuleName:        t.RuleName,
+		RuleDescription: t.RuleData.Description,
+		Severity:        t.RuleData.Severity,
+		Tags:            t.RuleData.Tags,
+		Location:        t.Injection.Location,
+		Parameter:       t.Injection.Parameter,
+		Payload:         t.Injection.Payload,
+		Encoders:        t.Injection.Encoders,
+		Method:          t.Injection.Injected.Method,
+		InjectedUrl:     t.Injection.Injected.Url,
+		InjectedBody:    t.Injection.Injected.Body,
+		BaselineUrl:     t.Injection.Baseline.Url,
+		Timestamp:       time.Now(),
 	}
+}
 
-	ruleEvaluation := t.RuleData.evaluate(resp, t.UrlInjection, t.RuleName, heuristicsResponse, baselineResponse)
-	if ruleEvaluation.Successful {
-		printGreen(ruleEvaluation.SuccessMessage)
-		if opts.ToSlack {
-			err = sendSlackMessage(ruleEvaluation.SuccessMessage)
-			if err != nil && opts.Debug {
-				printRed(os.Stderr, "error sending Slack message: %v\n", err)
-			}
+// Record a positive match, and replay the injected request or send it to Slack if enabled
+func reportMatch(result EvaluationResult, injected Request, message string) {
+	stats.recordMatch(result.RuleName)
+	if err := recordResult(result, message); err != nil {
+		printRed(os.Stderr, "error writing result to %v: %v\n", opts.OutputFile, err)
+	}
+	if config.replayClient != nil {
+		if err := replayRequest(injected); err != nil && opts.Debug {
+			printRed(os.Stderr, "error replaying %v through %v: %v\n", injected, opts.ReplayProxy, err)
+		}
+	}
+	if opts.ToSlack {
+		if err := sendSlackMessage(message); err != nil && opts.Debug {
+			printRed(os.Stderr, "error sending Slack message: %v\n", err)
 		}
 	}
 }
+
+// Confirm a time based match isn't just a slow host. Both the original delay, and a second, different delay must
+// be reflected in the response times when compared against the baseline request
+func (t Task) verifyTiming(resp Response) (bool, error) {
+	baselineResponse, err := t.send(t.Injection.Baseline)
+	if err != nil {
+		return false, err
+	}
+
+	if !isDelayedBy(resp.Duration, baselineResponse.Duration, t.RuleData.Timing.Delay) {
+		return false, nil
+	}
+
+	verifyResponse, err := t.send(t.Injection.Verify)
+	if err != nil {
+		return false, err
+	}
+
+	if !isDelayedBy(verifyResponse.Duration, baselineResponse.Duration, t.RuleData.Timing.VerifyDelay) {
+		return false, nil
+	}
+
+	// The difference between the two delays should also show in the response times, otherwise the delay isn't
+	// being controlled by the injection
+	if t.RuleData.Timing.Delay > t.RuleData.Timing.VerifyDelay {
+		return isDelayedBy(resp.Duration, verifyResponse.Duration, t.RuleData.Timing.Delay-t.RuleData.Timing.VerifyDelay), nil
+	}
+	return isDelayedBy(verifyResponse.Duration, resp.Duration, t.RuleData.Timing.VerifyDelay-t.RuleData.Timing.Delay), nil
+}
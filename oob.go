@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blind injections (such as SSRF and XXE) are detected by injecting a unique subdomain of the OOB domain for each
+// task, and listening for the target looking it up (DNS) or requesting it (HTTP). Each interaction is mapped back to
+// the task that injected its token, and reported as a positive match
+type OobServer struct {
+	mutex  sync.Mutex
+	domain string
+	// Included in injected URLs when the HTTP listener isn't on port 80
+	httpPort string
+	// The address DNS queries for the OOB domain are answered with, if any
+	answerIp net.IP
+	// How long interactions are accepted for once a task is complete
+	grace time.Duration
+	// Tasks that have been sent, by the token they injected, until their grace period has passed
+	tasks     map[string]*oobTask
+	lastPrune time.Time
+
+	httpServer *http.Server
+	dnsConn    net.PacketConn
+	// Closed once the DNS listener has stopped reading queries
+	dnsDone chan struct{}
+}
+
+// Only what's needed to report an interaction is kept for each task, rather than the task itself (with its rule and
+// all of its requests), as large scans can have many tasks waiting for interactions
+type oobTask struct {
+	result      EvaluationResult
+	description string
+	// The injected request is only kept to be replayed, when -replay-proxy is used
+	injected Request
+	// Zero until the task is complete
+	expires time.Time
+	// The protocols the task's interactions have already been reported for
+	reported map[string]bool
+}
+
+type OobInteraction struct {
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Data       string    `json:"data"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+var oobServer *OobServer
+
+func startOobServer(domain string, httpAddr string, dnsAddr string, answerIp string, grace time.Duration) (*OobServer, error) {
+	s := &OobServer{
+		domain:    strings.ToLower(strings.Trim(domain, ".")),
+		answerIp:  net.ParseIP(answerIp),
+		grace:     grace,
+		tasks:     make(map[string]*oobTask),
+		lastPrune: time.Now(),
+	}
+
+	if httpAddr != "" {
+		listener, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			return nil, err
+		}
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		if port != "80" {
+			s.httpPort = port
+		}
+
+		s.httpServer = &http.Server{Handler: http.HandlerFunc(s.serveHttp), ReadTimeout: 10 * time.Second}
+		go s.httpServer.Serve(listener)
+	}
+
+	if dnsAddr != "" {
+		conn, err := net.ListenPacket("udp", dnsAddr)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.dnsConn = conn
+		s.dnsDone = make(chan struct{})
+		go s.serveDns()
+	}
+	return s, nil
+}
+
+// The hostname injected by [[oob]]
+func (s *OobServer) host(token string) string {
+	return token + "." + s.domain
+}
+
+// The URL injected by [[ooburl]]. The token is in the path as well, in case the subdomain doesn't resolve to the HTTP
+// listener (i.e. when testing locally)
+func (s *OobServer) url(token string) string {
+	host := s.host(token)
+	if s.httpPort != "" {
+		host = net.JoinHostPort(host, s.httpPort)
+	}
+	return "http://" + host + "/" + token
+}
+
+// Remember a task before its requests are sent, so interactions with its token can be mapped back to it
+func (s *OobServer) register(t Task) {
+	task := &oobTask{
+		result:      t.newResult(),
+		description: describeInjection(t.Injection),
+		reported:    make(map[string]bool),
+	}
+	if config.replayClient != nil {
+		task.injected = t.Injection.Injected
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Retried tasks are registered again, keeping the interactions that were already reported
+	if existing, ok := s.tasks[t.Injection.Token]; ok {
+		task.reported = existing.reported
+	}
+	s.tasks[t.Injection.Token] = task
+	s.prune()
+}
+
+// Start a task's grace period once its requests have been sent. Interactions often come from the target processing
+// the request after responding (or from a later lookup), so they're still accepted until it's over
+func (s *OobServer) complete(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if task, ok := s.tasks[token]; ok {
+		task.expires = time.Now().Add(s.grace)
+	}
+}
+
+// Forget tasks whose grace period has passed. Every task is checked at most once per grace period, so registering
+// tasks stays cheap
+func (s *OobServer) prune() {
+	now := time.Now()
+	if now.Sub(s.lastPrune) < s.grace {
+		return
+	}
+	s.lastPrune = now
+	for token, task := range s.tasks {
+		if !task.expires.IsZero() && now.After(task.expires) {
+			delete(s.tasks, token)
+		}
+	}
+}
+
+// Get the token from a hostname, which is the label directly below the OOB domain (so tokens can be nested in
+// other subdomains)
+func (s *OobServer) hostToken(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.HasSuffix(host, "."+s.domain) {
+		return ""
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."+s.domain), ".")
+	return labels[len(labels)-1]
+}
+
+func (s *OobServer) serveHttp(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	candidates := append([]string{s.hostToken(host)}, strings.Split(r.URL.Path, "/")...)
+	interaction := OobInteraction{
+		Protocol:   "http",
+		RemoteAddr: r.RemoteAddr,
+		Data:       fmt.Sprintf("%v %v (Host: %v)", r.Method, r.RequestURI, r.Host),
+		Timestamp:  time.Now(),
+	}
+	for _, token := range candidates {
+		if s.interaction(token, interaction) {
+			break
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *OobServer) serveDns() {
+	defer close(s.dnsDone)
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := s.dnsConn.ReadFrom(buffer)
+		if err != nil {
+			// The connection is only closed once the scan is complete
+			return
+		}
+
+		query := append([]byte(nil), buffer[:n]...)
+		name, qtype, questionEnd, err := parseDnsQuestion(query)
+		if err != nil {
+			if opts.Debug {
+				printRed(os.Stderr, "invalid DNS query from %v: %v\n", addr, err)
+			}
+			continue
+		}
+
+		token := s.hostToken(name)
+		if token != "" {
+			s.interaction(token, OobInteraction{
+				Protocol:   "dns",
+				RemoteAddr: addr.String(),
+				Data:       fmt.Sprintf("%v %v", dnsTypeName(qtype), name),
+				Timestamp:  time.Now(),
+			})
+		}
+
+		s.dnsConn.WriteTo(s.dnsResponse(query, name, qtype, questionEnd), addr)
+	}
+}
+
+// Record an interaction with a token, reporting it if the token belongs to a task. Each task is only reported once
+// per protocol, as targets often look up or request the same URL several times
+func (s *OobServer) interaction(token string, interaction OobInteraction) bool {
+	if token == "" {
+		return false
+	}
+
+	s.mutex.Lock()
+	task, ok := s.tasks[token]
+	ok = ok && (task.expires.IsZero() || time.Now().Before(task.expires))
+	isNew := ok && !task.reported[interaction.Protocol]
+	if isNew {
+		task.reported[interaction.Protocol] = true
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		if opts.Debug {
+			printRed(os.Stderr, "out-of-band %v interaction from %v for unknown or expired token %v\n", interaction.Protocol, interaction.RemoteAddr, token)
+		}
+		return false
+	}
+	if isNew {
+		task.reportInteraction(interaction)
+	}
+	return true
+}
+
+func (t *oobTask) reportInteraction(interaction OobInteraction) {
+	result := t.result
+	result.MatchedChecks = []string{"oob:" + interaction.Protocol}
+	result.Interaction = &interaction
+	result.Timestamp = interaction.Timestamp
+
+	message := fmt.Sprintf("[%s] out-of-band %v interaction from %v for %v\n", result.RuleName, interaction.Protocol, interaction.RemoteAddr, t.description)
+	reportMatch(result, t.injected, message)
+}
+
+// Wait for interactions from requests that were sent near the end of the scan, unless the scan is interrupted
+func (s *OobServer) wait(grace time.Duration) {
+	if grace <= 0 {
+		return
+	}
+	if !opts.SilentMode {
+		printCyan(os.Stderr, "Waiting %v for out-of-band interactions\n", grace)
+	}
+	select {
+	case <-time.After(grace):
+	case <-interrupted:
+	}
+}
+
+// Stop listening, letting interactions that are being handled finish first, so they're reported before the output is
+// closed. Handlers are only given a few seconds, as they may be replaying requests through -replay-proxy
+func (s *OobServer) close() {
+	if s.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			s.httpServer.Close()
+		}
+	}
+	if s.dnsConn != nil {
+		s.dnsConn.Close()
+		<-s.dnsDone
+	}
+}
+
+// Parse the question of a DNS query, returning the name, type, and where the question ends in the query
+func parseDnsQuestion(query []byte) (string, uint16, int, error) {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:6]) == 0 {
+		return "", 0, 0, errors.New("query has no question")
+	}
+
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return "", 0, 0, errors.New("truncated name")
+		}
+		length := int(query[offset])
+		offset += 1
+		if length == 0 {
+			break
+		}
+		// Questions are the first name in a message, so they're never compressed
+		if length > 63 || offset+length > len(query) {
+			return "", 0, 0, errors.New("invalid label")
+		}
+		labels = append(labels, string(query[offset:offset+length]))
+		offset += length
+	}
+
+	if offset+4 > len(query) {
+		return "", 0, 0, errors.New("truncated question")
+	}
+	qtype := binary.BigEndian.Uint16(query[offset : offset+2])
+	return strings.Join(labels, "."), qtype, offset + 4, nil
+}
+
+const (
+	dnsTypeA   = 1
+	dnsTypeAny = 255
+)
+
+func dnsTypeName(qtype uint16) string {
+	names := map[uint16]string{1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 15: "MX", 16: "TXT", 28: "AAAA", 255: "ANY"}
+	if name, ok := names[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%v", qtype)
+}
+
+// Answer A queries for the OOB domain with the answer IP (if there is one), so targets go on to make HTTP requests.
+// Names outside the OOB domain are refused
+func (s *OobServer) dnsResponse(query []byte, name string, qtype uint16, questionEnd int) []byte {
+	name = strings.ToLower(name)
+	inDomain := name == s.domain || strings.HasSuffix(name, "."+s.domain)
+
+	// Keep the query's opcode and recursion desired flag, and set the response and authoritative answer flags
+	flags := binary.BigEndian.Uint16(query[2:4])&0x7900 | 0x8400
+	if !inDomain {
+		flags |= 5
+	}
+
+	ip := s.answerIp.To4()
+	answer := inDomain && ip != nil && (qtype == dnsTypeA || qtype == dnsTypeAny)
+
+	response := make([]byte, 12, questionEnd+16)
+	copy(response, query[:2])
+	binary.BigEndian.PutUint16(response[2:4], flags)
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	response = append(response, query[12:questionEnd]...)
+	if answer {
+		binary.BigEndian.PutUint16(response[6:8], 1)
+		// A pointer to the name in the question, followed by type A, class IN, a TTL of 0 and the address
+		response = append(response, 0xc0, 12, 0, dnsTypeA, 0, 1, 0, 0, 0, 0, 0, 4)
+		response = append(response, ip...)
+	}
+	return response
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Build a DNS query with a single question
+func dnsQuery(id uint16, flags uint16, name string, qtype uint16) []byte {
+	query := make([]byte, 12)
+	binary.BigEndian.PutUint16(query[0:2], id)
+	binary.BigEndian.PutUint16(query[2:4], flags)
+	binary.BigEndian.PutUint16(query[4:6], 1)
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			query = append(query, byte(len(label)))
+			query = append(query, label...)
+		}
+	}
+	query = append(query, 0)
+	return append(query, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+func TestParseDnsQuestion(t *testing.T) {
+	header := func(qdcount byte) []byte { return []byte{0x12, 0x34, 1, 0, 0, qdcount, 0, 0, 0, 0, 0, 0} }
+	withQuestion := func(question ...byte) []byte { return append(header(1), question...) }
+	// An EDNS OPT record, which resolvers commonly add after the question
+	opt := []byte{0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0}
+	withAdditional := dnsQuery(1, 0x0100, "x.oob.test", 16)
+	withAdditional[11] = 1
+	withAdditional = append(withAdditional, opt...)
+
+	tests := []struct {
+		name        string
+		query       []byte
+		host        string
+		qtype       uint16
+		questionEnd int
+		err         string
+	}{
+		{"valid", dnsQuery(1, 0x0100, "abc.oob.test", 1), "abc.oob.test", 1, 30, ""},
+		{"root", dnsQuery(1, 0, "", 2), "", 2, 17, ""},
+		{"additional records are ignored", withAdditional, "x.oob.test", 16, 28, ""},
+		{"longest label", dnsQuery(1, 0, strings.Repeat("a", 63)+".test", 1), strings.Repeat("a", 63) + ".test", 1, 86, ""},
+		// Labels are raw bytes, which may include dots
+		{"dot in label", withQuestion(3, 'a', '.', 'b', 0, 0, 1, 0, 1), "a.b", 1, 21, ""},
+
+		{"empty", nil, "", 0, 0, "query has no question"},
+		{"short header", header(1)[:11], "", 0, 0, "query has no question"},
+		{"no questions", append(header(0), dnsQuery(1, 0, "a.test", 1)[12:]...), "", 0, 0, "query has no question"},
+		{"header only", header(1), "", 0, 0, "truncated name"},
+		{"truncated label", withQuestion(5, 'a', 'b'), "", 0, 0, "invalid label"},
+		{"missing terminator", withQuestion(1, 'a'), "", 0, 0, "truncated name"},
+		{"label too long", withQuestion(append([]byte{64}, bytes.Repeat([]byte{'a'}, 64)...)...), "", 0, 0, "invalid label"},
+		{"compression pointer", withQuestion(0xc0, 12, 0, 1, 0, 1), "", 0, 0, "invalid label"},
+		{"pointer loop", withQuestion(0xc0, 12), "", 0, 0, "invalid label"},
+		{"missing type", withQuestion(1, 'a', 0), "", 0, 0, "truncated question"},
+		{"missing class", withQuestion(1, 'a', 0, 0, 1), "", 0, 0, "truncated question"},
+		{"truncated class", withQuestion(1, 'a', 0, 0, 1, 0), "", 0, 0, "truncated question"},
+	}
+
+	for _, test := range tests {
+		host, qtype, questionEnd, err := parseDnsQuestion(test.query)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%v: parseDnsQuestion returned error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: parseDnsQuestion returned error: %v", test.name, err)
+			continue
+		}
+		if host != test.host || qtype != test.qtype || questionEnd != test.questionEnd {
+			t.Errorf("%v: parseDnsQuestion = %q, %v, %v, want %q, %v, %v", test.name, host, qtype, questionEnd, test.host, test.qtype, test.questionEnd)
+		}
+	}
+}
+
+func TestDnsResponse(t *testing.T) {
+	answer := []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 127, 0, 0, 1}
+
+	tests := []struct {
+		name     string
+		answerIp string
+		query    []byte
+		flags    uint16
+		answer   []byte
+	}{
+		{"A query", "127.0.0.1", dnsQuery(0xbeef, 0x0100, "tok.oob.test", dnsTypeA), 0x8500, answer},
+		{"ANY query", "127.0.0.1", dnsQuery(0xbeef, 0, "tok.oob.test", dnsTypeAny), 0x8400, answer},
+		{"names are case insensitive", "127.0.0.1", dnsQuery(0xbeef, 0, "TOK.OOB.Test", dnsTypeA), 0x8400, answer},
+		{"the domain itself", "127.0.0.1", dnsQuery(0xbeef, 0, "oob.test", dnsTypeA), 0x8400, answer},
+		{"AAAA query", "127.0.0.1", dnsQuery(0xbeef, 0, "tok.oob.test", 28), 0x8400, nil},
+		{"without an answer IP", "", dnsQuery(0xbeef, 0, "tok.oob.test", dnsTypeA), 0x8400, nil},
+		{"IPv6 answer IP", "::1", dnsQuery(0xbeef, 0, "tok.oob.test", dnsTypeA), 0x8400, nil},
+		{"outside the domain", "127.0.0.1", dnsQuery(0xbeef, 0x0100, "example.com", dnsTypeA), 0x8505, nil},
+		{"suffix without a dot", "127.0.0.1", dnsQuery(0xbeef, 0, "evil-oob.test", dnsTypeA), 0x8405, nil},
+		// Only the opcode and recursion desired flags are kept from the query
+		{"query flags", "127.0.0.1", dnsQuery(0xbeef, 0xffff, "tok.oob.test", dnsTypeA), 0xfd00, answer},
+	}
+
+	for _, test := range tests {
+		s := &OobServer{domain: "oob.test", answerIp: net.ParseIP(test.answerIp)}
+		host, qtype, questionEnd, err := parseDnsQuestion(test.query)
+		if err != nil {
+			t.Fatalf("%v: parseDnsQuestion returned error: %v", test.name, err)
+		}
+
+		response := s.dnsResponse(test.query, host, qtype, questionEnd)
+		if len(response) < 12 {
+			t.Fatalf("%v: response is only %v bytes", test.name, len(response))
+		}
+		if id := binary.BigEndian.Uint16(response[0:2]); id != 0xbeef {
+			t.Errorf("%v: response ID is %x", test.name, id)
+		}
+		if flags := binary.BigEndian.Uint16(response[2:4]); flags != test.flags {
+			t.Errorf("%v: response flags are %04x, want %04x", test.name, flags, test.flags)
+		}
+
+		ancount := 0
+		if test.answer != nil {
+			ancount = 1
+		}
+		counts := []uint16{1, uint16(ancount), 0, 0}
+		for i, want := range counts {
+			if count := binary.BigEndian.Uint16(response[4+i*2 : 6+i*2]); count != want {
+				t.Errorf("%v: response count %v is %v, want %v", test.name, i, count, want)
+			}
+		}
+
+		if !bytes.Equal(response[12:questionEnd], test.query[12:questionEnd]) {
+			t.Errorf("%v: response question is %v, want %v", test.name, response[12:questionEnd], test.query[12:questionEnd])
+		}
+		if !bytes.Equal(response[questionEnd:], test.answer) {
+			t.Errorf("%v: response answer is %v, want %v", test.name, response[questionEnd:], test.answer)
+		}
+	}
+}
+
+// Every prefix of a valid query, and random packets, must be rejected or answered without panicking
+func TestDnsMalformedQueries(t *testing.T) {
+	s := &OobServer{domain: "oob.test", answerIp: net.ParseIP("127.0.0.1")}
+	answer := func(query []byte) {
+		host, qtype, questionEnd, err := parseDnsQuestion(query)
+		if err != nil {
+			return
+		}
+		if questionEnd > len(query) {
+			t.Fatalf("parseDnsQuestion(%v) returned a question end of %v", query, questionEnd)
+		}
+		s.dnsResponse(query, host, qtype, questionEnd)
+	}
+
+	query := dnsQuery(1, 0x0100, "tok.oob.test", dnsTypeA)
+	for i := 0; i <= len(query); i++ {
+		answer(query[:i])
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		packet := make([]byte, random.Intn(64))
+		random.Read(packet)
+		// Mostly well formed headers, so the question parsing is exercised
+		if len(packet) >= 6 && i%2 == 0 {
+			packet[4], packet[5] = 0, 1
+		}
+		answer(packet)
+	}
+}
+
+func TestOobHostToken(t *testing.T) {
+	s := &OobServer{domain: "oob.test"}
+	tests := map[string]string{
+		"tok.oob.test":         "tok",
+		"TOK.OOB.TEST.":        "tok",
+		"a.b.tok.oob.test":     "tok",
+		"oob.test":             "",
+		"tok.evil-oob.test":    "",
+		"tok.oob.test.evil.io": "",
+		"":                     "",
+	}
+
+	for host, want := range tests {
+		if got := s.hostToken(host); got != want {
+			t.Errorf("hostToken(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var openApiMethods = []string{"get", "put", "post", "delete", "options", "head", "patch"}
+
+// The most references followed to resolve a single object, in case they form a loop
+const maxRefDepth = 8
+
+// An OpenAPI 2 (Swagger) or 3 document, kept as generic JSON values so both versions (and $refs) can be handled the
+// same way
+type openApiSpec struct {
+	document map[string]interface{}
+	baseUrl  *url.URL
+}
+
+// Read an OpenAPI document in JSON or YAML, and generate a request for every operation, filling in each parameter
+// with its example value, or a value based on its type
+func readOpenApiRequests(input io.Reader, emit func(Request)) error {
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+
+	spec, err := parseOpenApiSpec(content)
+	if err != nil {
+		return err
+	}
+
+	paths := spec.object(spec.document["paths"])
+	for _, path := range sortedKeys(paths) {
+		pathItem := spec.object(paths[path])
+		for _, method := range openApiMethods {
+			operation, ok := pathItem[method]
+			if !ok {
+				continue
+			}
+
+			request, err := spec.operationRequest(path, method, pathItem, spec.object(operation))
+			if err != nil {
+				if opts.Debug {
+					printRed(os.Stderr, "error generating request for %v %v: %v\n", strings.ToUpper(method), path, err)
+				}
+				continue
+			}
+			emit(request)
+		}
+	}
+	return nil
+}
+
+func parseOpenApiSpec(content []byte) (*openApiSpec, error) {
+	var document interface{}
+	if trimmed := strings.TrimSpace(string(content)); strings.HasPrefix(trimmed, "{") {
+		decoded, err := decodeJson(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+		}
+		document = decoded
+	} else {
+		var decoded interface{}
+		if err := yaml.Unmarshal(content, &decoded); err != nil {
+			return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+		}
+		document = fromYaml(decoded)
+	}
+
+	spec := &openApiSpec{}
+	spec.document, _ = document.(map[string]interface{})
+	if spec.document == nil || (spec.document["openapi"] == nil && spec.document["swagger"] == nil) {
+		return nil, errors.New("invalid OpenAPI document: missing openapi or swagger version")
+	}
+
+	baseUrl, err := spec.getBaseUrl()
+	if err != nil {
+		return nil, err
+	}
+	spec.baseUrl = baseUrl
+	return spec, nil
+}
+
+// YAML objects are decoded with keys of any type, so convert them to match JSON objects
+func fromYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			object[fmt.Sprint(key)] = fromYaml(val)
+		}
+		return object
+	case []interface{}:
+		for i, val := range v {
+			v[i] = fromYaml(val)
+		}
+	}
+	return value
+}
+
+// The base URL is taken from -base-url, or the document's first server (OpenAPI 3) or host (OpenAPI 2)
+func (s *openApiSpec) getBaseUrl() (*url.URL, error) {
+	base := opts.BaseUrl
+	if base == "" {
+		if servers, ok := s.document["servers"].([]interface{}); ok && len(servers) > 0 {
+			base, _ = s.object(servers[0])["url"].(string)
+		} else if host, ok := s.document["host"].(string); ok {
+			scheme := "https"
+			if schemes, ok := s.document["schemes"].([]interface{}); ok && len(schemes) > 0 {
+				scheme = fmt.Sprint(schemes[0])
+			}
+			basePath, _ := s.document["basePath"].(string)
+			base = scheme + "://" + host + basePath
+		}
+	}
+
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("the OpenAPI document doesn't include an absolute server URL, so -base-url is required")
+	}
+	return u, nil
+}
+
+func (s *openApiSpec) operationRequest(path string, method string, pathItem map[string]interface{}, operation map[string]interface{}) (Request, error) {
+	request := Request{Method: strings.ToUpper(method), Headers: make(map[string]string)}
+	query := url.Values{}
+	form := url.Values{}
+	var cookies []string
+
+	// Path parameters are injected by their segment, counting the segments of the base URL's path
+	basePath := strings.Trim(s.baseUrl.EscapedPath(), "/")
+	baseSegments := 0
+	if basePath != "" {
+		baseSegments = len(strings.Split(basePath, "/"))
+	}
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for _, parameter := range s.parameters(pathItem, operation) {
+		name, _ := parameter["name"].(string)
+		value := s.parameterValue(parameter)
+
+		switch parameter["in"] {
+		case "path":
+			path = strings.Replace(path, "{"+name+"}", url.PathEscape(value), -1)
+			for i, segment := range pathSegments {
+				if strings.Contains(segment, "{"+name+"}") {
+					request.declaredPoints = append(request.declaredPoints, fmt.Sprintf("path:%v", baseSegments+i+1))
+				}
+			}
+		case "query":
+			query.Add(name, value)
+		case "header":
+			request.Headers[name] = value
+			request.declaredPoints = append(request.declaredPoints, "header:"+name)
+		case "cookie":
+			cookies = append(cookies, name+"="+value)
+			request.declaredPoints = append(request.declaredPoints, "cookie:"+name)
+		case "formData":
+			form.Add(name, value)
+		case "body":
+			body, err := encodeJson(s.schemaExample(parameter["schema"], make(map[string]bool)))
+			if err != nil {
+				return request, err
+			}
+			request.Body = body
+			request.Headers["Content-Type"] = "application/json"
+		}
+	}
+
+	if len(cookies) > 0 {
+		request.Headers["Cookie"] = strings.Join(cookies, "; ")
+	}
+	if len(form) > 0 {
+		request.Body = form.Encode()
+		request.Headers["Content-Type"] = "application/x-www-form-urlencoded"
+	}
+
+	if requestBody, ok := operation["requestBody"]; ok {
+		if err := s.addRequestBody(&request, s.object(requestBody)); err != nil {
+			return request, err
+		}
+	}
+
+	// Path parameters have already been escaped, so the path is resolved as an escaped reference
+	u, err := s.baseUrl.Parse(strings.TrimSuffix(s.baseUrl.EscapedPath(), "/") + path)
+	if err != nil {
+		return request, err
+	}
+	u.RawQuery = query.Encode()
+	request.Url = u.String()
+	return request, nil
+}
+
+// Operation parameters override path item parameters with the same name and location
+func (s *openApiSpec) parameters(pathItem map[string]interface{}, operation map[string]interface{}) []map[string]interface{} {
+	var parameters []map[string]interface{}
+	index := make(map[string]int)
+	for _, source := range []interface{}{pathItem["parameters"], operation["parameters"]} {
+		list, _ := source.([]interface{})
+		for _, p := range list {
+			parameter := s.object(p)
+			key := fmt.Sprintf("%v %v", parameter["in"], parameter["name"])
+			if i, ok := index[key]; ok {
+				parameters[i] = parameter
+				continue
+			}
+			index[key] = len(parameters)
+			parameters = append(parameters, parameter)
+		}
+	}
+	return parameters
+}
+
+// JSON bodies are preferred, then form bodies. Other content types (such as multipart bodies) are skipped
+func (s *openApiSpec) addRequestBody(request *Request, requestBody map[string]interface{}) error {
+	content := s.object(requestBody["content"])
+	for mediaType, media := range content {
+		if !strings.Contains(mediaType, "json") {
+			continue
+		}
+		mediaObject := s.object(media)
+		example, ok := mediaObject["example"]
+		if !ok {
+			example = s.schemaExample(mediaObject["schema"], make(map[string]bool))
+		}
+		body, err := encodeJson(example)
+		if err != nil {
+			return err
+		}
+		request.Body = body
+		request.Headers["Content-Type"] = mediaType
+		return nil
+	}
+
+	if media, ok := content["application/x-www-form-urlencoded"]; ok {
+		form := url.Values{}
+		example, _ := s.schemaExample(s.object(media)["schema"], make(map[string]bool)).(map[string]interface{})
+		for _, name := range sortedKeys(example) {
+			form.Set(name, exampleString(example[name]))
+		}
+		request.Body = form.Encode()
+		request.Headers["Content-Type"] = "application/x-www-form-urlencoded"
+	}
+	return nil
+}
+
+func (s *openApiSpec) parameterValue(parameter map[string]interface{}) string {
+	if example, ok := parameter["example"]; ok {
+		return exampleString(example)
+	}
+	if example, ok := parameter["x-example"]; ok {
+		return exampleString(example)
+	}
+	if examples := s.object(parameter["examples"]); len(examples) > 0 {
+		if value, ok := s.object(examples[sortedKeys(examples)[0]])["value"]; ok {
+			return exampleString(value)
+		}
+	}
+
+	// OpenAPI 2 parameters have their type on the parameter itself, rather than a schema
+	schema, ok := parameter["schema"]
+	if !ok {
+		schema = parameter
+	}
+	return exampleString(s.schemaExample(schema, make(map[string]bool)))
+}
+
+// Generate an example value for a schema, using its example, default or first enum value if it has one. Schemas can
+// refer to themselves (i.e. a user with a list of friends), so references already being expanded are left out
+func (s *openApiSpec) schemaExample(schemaValue interface{}, expanding map[string]bool) interface{} {
+	reference, _ := schemaValue.(map[string]interface{})
+	if ref, ok := reference["$ref"].(string); ok {
+		if expanding[ref] {
+			return nil
+		}
+		expanding[ref] = true
+		defer delete(expanding, ref)
+	}
+	schema := s.object(schemaValue)
+
+	for _, key := range []string{"example", "default", "x-example"} {
+		if value, ok := schema[key]; ok {
+			return value
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		return enum[0]
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		merged := make(map[string]interface{})
+		for _, subschema := range allOf {
+			if object, ok := s.schemaExample(subschema, expanding).(map[string]interface{}); ok {
+				for key, value := range object {
+					merged[key] = value
+				}
+			}
+		}
+		return merged
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		if options, ok := schema[key].([]interface{}); ok && len(options) > 0 {
+			return s.schemaExample(options[0], expanding)
+		}
+	}
+
+	schemaType, _ := schema["type"].(string)
+	if properties, ok := schema["properties"]; ok || schemaType == "object" {
+		object := make(map[string]interface{})
+		for name, property := range s.object(properties) {
+			if value := s.schemaExample(property, expanding); value != nil {
+				object[name] = value
+			}
+		}
+		return object
+	}
+
+	format, _ := schema["format"].(string)
+	switch schemaType {
+	case "array":
+		if item := s.schemaExample(schema["items"], expanding); item != nil {
+			return []interface{}{item}
+		}
+		return []interface{}{}
+	case "integer":
+		return 1
+	case "number":
+		return 1.5
+	case "boolean":
+		return true
+	}
+
+	switch format {
+	case "date":
+		return "2020-01-01"
+	case "date-time":
+		return "2020-01-01T00:00:00Z"
+	case "uuid":
+		return "00000000-0000-0000-0000-000000000000"
+	case "email":
+		return "test@example.com"
+	case "uri", "url":
+		return "https://example.com"
+	}
+	return "test"
+}
+
+// Get an object from the document, following it if it's a reference within the document (i.e. #/definitions/User)
+func (s *openApiSpec) object(value interface{}) map[string]interface{} {
+	for i := 0; i < maxRefDepth; i++ {
+		object, _ := value.(map[string]interface{})
+		ref, ok := object["$ref"].(string)
+		if !ok {
+			return object
+		}
+		value = s.resolve(ref)
+	}
+	return nil
+}
+
+func (s *openApiSpec) resolve(ref string) interface{} {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil
+	}
+
+	var node interface{} = s.document
+	for _, segment := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		// JSON pointer escapes
+		segment = strings.Replace(strings.Replace(segment, "~1", "/", -1), "~0", "~", -1)
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = object[segment]
+	}
+	return node
+}
+
+// Format an example value as a parameter value. Arrays are comma separated, and objects are JSON
+func exampleString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = exampleString(item)
+		}
+		return strings.Join(values, ",")
+	case map[string]interface{}:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
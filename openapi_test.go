@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Path parameters are declared as injection points by their segment in the full URL, including the base URL's path
+func TestOpenApiDeclaredPoints(t *testing.T) {
+	parameters := `[
+		{"name": "id", "in": "path", "example": "5"},
+		{"name": "postId", "in": "path", "example": "a b"},
+		{"name": "X-Api-Key", "in": "header", "example": "key"},
+		{"name": "session", "in": "cookie", "example": "abc"},
+		{"name": "q", "in": "query", "example": "1"}
+	]`
+	tests := []struct {
+		name string
+		// The version and base URL of the document
+		server string
+		path   string
+		url    string
+		points []string
+	}{
+		{
+			"base path",
+			`"openapi": "3.0.0", "servers": [{"url": "https://example.com/api/v1"}]`,
+			"/users/{id}/posts/{postId}",
+			"https://example.com/api/v1/users/5/posts/a%20b?q=1",
+			[]string{"path:4", "path:6", "header:X-Api-Key", "cookie:session"},
+		},
+		{
+			"no base path",
+			`"openapi": "3.0.0", "servers": [{"url": "https://example.com"}]`,
+			"/users/{id}/posts/{postId}",
+			"https://example.com/users/5/posts/a%20b?q=1",
+			[]string{"path:2", "path:4", "header:X-Api-Key", "cookie:session"},
+		},
+		{
+			"base path with a trailing slash",
+			`"openapi": "3.0.0", "servers": [{"url": "https://example.com/api/"}]`,
+			"/users/{id}/posts/{postId}/",
+			"https://example.com/api/users/5/posts/a%20b/?q=1",
+			[]string{"path:3", "path:5", "header:X-Api-Key", "cookie:session"},
+		},
+		{
+			"parameters within a segment",
+			`"openapi": "3.0.0", "servers": [{"url": "https://example.com/v2"}]`,
+			"/{id}/{id}-{postId}.json",
+			"https://example.com/v2/5/5-a%20b.json?q=1",
+			[]string{"path:2", "path:3", "path:3", "header:X-Api-Key", "cookie:session"},
+		},
+		{
+			"OpenAPI 2 base path",
+			`"swagger": "2.0", "host": "example.com", "basePath": "/v2"`,
+			"/users/{id}/posts/{postId}",
+			"https://example.com/v2/users/5/posts/a%20b?q=1",
+			[]string{"path:3", "path:5", "header:X-Api-Key", "cookie:session"},
+		},
+	}
+
+	for _, test := range tests {
+		document := `{` + test.server + `, "paths": {"` + test.path + `": {"get": {"parameters": ` + parameters + `}}}}`
+		var requests []Request
+		err := readOpenApiRequests(strings.NewReader(document), func(request Request) {
+			requests = append(requests, request)
+		})
+		if err != nil || len(requests) != 1 {
+			t.Errorf("%v: readOpenApiRequests returned %v requests and error %v", test.name, len(requests), err)
+			continue
+		}
+
+		request := requests[0]
+		if request.Url != test.url {
+			t.Errorf("%v: request URL is %v, want %v", test.name, request.Url, test.url)
+		}
+		if !reflect.DeepEqual(request.declaredPoints, test.points) {
+			t.Errorf("%v: declared points are %q, want %q", test.name, request.declaredPoints, test.points)
+		}
+
+		// The declared segments are the ones holding the path parameters' values
+		segments, err := pathInjectionPoints(request, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, point := range request.declaredPoints {
+			if !strings.HasPrefix(point, "path:") {
+				continue
+			}
+			index, _ := strconv.Atoi(strings.TrimPrefix(point, "path:"))
+			if index > len(segments) {
+				t.Errorf("%v: %v is past the end of the path", test.name, point)
+				continue
+			}
+			if value := segments[index-1].OriginalValue; !strings.Contains(value, "5") && !strings.Contains(value, "a b") {
+				t.Errorf("%v: %v is the segment %q, which has no path parameter", test.name, point, value)
+			}
+		}
+	}
+}
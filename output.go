@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var outputFormats = []string{"text", "jsonl", "sarif", "html"}
+
+// Report formats are written once all evaluations are complete, rather than as each positive match is found
+var reportFormats = map[string]func(w io.Writer, results []EvaluationResult) error{
+	"sarif": writeSarif,
+	"html":  writeHtmlReport,
+}
+
+var outputMutex sync.Mutex
+var outputFile *os.File
+
+func openOutput() error {
+	if opts.OutputFile == "" {
+		return nil
+	}
+
+	file, err := os.Create(opts.OutputFile)
+	if err != nil {
+		return err
+	}
+	outputFile = file
+	return nil
+}
+
+func closeOutput() error {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	if writeReport, ok := reportFormats[opts.OutputFormat]; ok {
+		var w io.Writer = os.Stdout
+		if outputFile != nil {
+			w = outputFile
+		}
+		if err := writeReport(w, evaluationResults); err != nil {
+			return err
+		}
+	}
+
+	if outputFile == nil {
+		return nil
+	}
+	return outputFile.Close()
+}
+
+// Record a positive match, printing it to stdout and writing it to the output file if one was provided. Results
+// are recorded by multiple workers at once, so this is done while holding a lock
+func recordResult(result EvaluationResult, message string) error {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	evaluationResults = append(evaluationResults, result)
+
+	// Structured formats are written to stdout instead of the human readable message when there's no output file,
+	// so results can be piped into other tools
+	_, isReport := reportFormats[opts.OutputFormat]
+	if opts.OutputFormat == "jsonl" && outputFile == nil {
+		line, err := encodeJson(result)
+		if err != nil {
+			return err
+		}
+		fmt.Println(line)
+	} else if !isReport || outputFile != nil {
+		printGreen(message)
+	}
+
+	if outputFile == nil {
+		return nil
+	}
+
+	if isReport {
+		return nil
+	}
+
+	switch opts.OutputFormat {
+	case "jsonl":
+		line, err := encodeJson(result)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(outputFile, line)
+		return err
+	default:
+		_, err := fmt.Fprint(outputFile, message)
+		return err
+	}
+}
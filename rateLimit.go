@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A token bucket holding at most one token, so requests are spread evenly rather than sent in bursts. Tokens can be
+// reserved ahead of time (taking the bucket negative), which queues waiting requests in order. A rate of 0 means
+// there's no limit
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: 1, last: time.Now()}
+}
+
+// Block until a token is available
+func (b *tokenBucket) wait() {
+	b.mutex.Lock()
+	if b.rate <= 0 {
+		b.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > 1 {
+		b.tokens = 1
+	}
+	b.last = now
+	b.tokens -= 1
+
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Halve the rate (or start limiting at the given rate if there was no limit), down to the minimum rate
+func (b *tokenBucket) slowDown(initialRate float64, minRate float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.rate <= 0 {
+		b.rate = initialRate
+	} else if b.rate/2 > minRate {
+		b.rate /= 2
+	} else {
+		b.rate = minRate
+	}
+}
+
+type hostLimit struct {
+	bucket *tokenBucket
+	// Buffered to the maximum number of concurrent requests to the host, or nil when there's no limit
+	slots chan struct{}
+
+	// Set when the host throttles requests, these are only accessed while holding the rate limiter's lock
+	pausedUntil time.Time
+	strikes     int
+	abandoned   bool
+}
+
+type RateLimiter struct {
+	mutex           sync.Mutex
+	global          *tokenBucket
+	hostRate        float64
+	hostConcurrency int
+	hosts           map[string]*hostLimit
+}
+
+var rateLimiter *RateLimiter
+
+// Rates are in requests per second, and a rate or concurrency of 0 means there's no limit
+func newRateLimiter(rate float64, hostRate float64, hostConcurrency int) *RateLimiter {
+	return &RateLimiter{
+		global:          newTokenBucket(rate),
+		hostRate:        hostRate,
+		hostConcurrency: hostConcurrency,
+		hosts:           make(map[string]*hostLimit),
+	}
+}
+
+func (l *RateLimiter) host(hostname string) *hostLimit {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit, ok := l.hosts[hostname]
+	if !ok {
+		limit = &hostLimit{bucket: newTokenBucket(l.hostRate)}
+		if l.hostConcurrency > 0 {
+			limit.slots = make(chan struct{}, l.hostConcurrency)
+		}
+		l.hosts[hostname] = limit
+	}
+	return limit
+}
+
+// Check whether requests can currently be sent to the host, so tasks for paused or abandoned hosts can be put aside
+// without holding up a worker
+func (l *RateLimiter) available(hostname string) error {
+	limit := l.host(hostname)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if limit.abandoned {
+		return errHostAbandoned
+	}
+	if time.Now().Before(limit.pausedUntil) {
+		return &ThrottledError{Host: hostname, Until: limit.pausedUntil}
+	}
+	return nil
+}
+
+// Block until a request can be sent to the host. The returned function must be called once the request is complete,
+// to free up the host's concurrency slot. If the host was paused part way through a task, this waits for the pause
+// to end, so the task's requests are still compared against each other
+func (l *RateLimiter) acquire(hostname string) (func(), error) {
+	limit := l.host(hostname)
+
+	l.mutex.Lock()
+	abandoned, pausedUntil := limit.abandoned, limit.pausedUntil
+	l.mutex.Unlock()
+
+	if abandoned {
+		return nil, errHostAbandoned
+	}
+	time.Sleep(time.Until(pausedUntil))
+
+	if limit.slots != nil {
+		limit.slots <- struct{}{}
+	}
+	limit.bucket.wait()
+	l.global.wait()
+
+	return func() {
+		if limit.slots != nil {
+			<-limit.slots
+		}
+	}, nil
+}
+
+// Check a response for signs of throttling. Throttled hosts are paused (for as long as their Retry-After header asks,
+// or an increasing amount of time) and slowed down, and abandoned if they keep throttling requests
+func (l *RateLimiter) recordResponse(hostname string, resp Response) error {
+	limit := l.host(hostname)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !config.Throttling.isThrottled(resp) {
+		limit.strikes = 0
+		return nil
+	}
+
+	// Requests that were already in flight when the host was paused don't count against it again
+	if time.Now().Before(limit.pausedUntil) {
+		return &ThrottledError{Host: hostname, Until: limit.pausedUntil}
+	}
+
+	limit.strikes += 1
+	if limit.strikes > config.Throttling.maxRetries {
+		limit.abandoned = true
+	}
+
+	pause := retryAfter(resp.Headers)
+	if pause <= 0 {
+		pause = throttlingPause << uint(limit.strikes-1)
+	}
+	if pause <= 0 || pause > maxThrottlingPause {
+		pause = maxThrottlingPause
+	}
+
+	limit.pausedUntil = time.Now().Add(pause)
+	limit.bucket.slowDown(throttledHostRate, minThrottledHostRate)
+
+	return &ThrottledError{Host: hostname, Until: limit.pausedUntil}
+}
+
+func (l *RateLimiter) abandonedHosts() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var hosts []string
+	for hostname, limit := range l.hosts {
+		if limit.abandoned {
+			hosts = append(hosts, hostname)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
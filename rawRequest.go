@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Regions of a raw request surrounded by this marker (i.e. id=§1§) are injected into, instead of its parameters
+const injectionMarker = "§"
+
+// Read a raw HTTP request from a file (such as one copied from Burp), to be injected by every rule
+func readRawRequestFile(path string, requests chan<- Request) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	request, err := parseMarkedRequest(string(content))
+	if err != nil {
+		return err
+	}
+
+	stats.recordInput()
+	requests <- request
+	return nil
+}
+
+// Parse a raw request that may contain injection markers. The request that's returned is the original request,
+// without the markers, which remembers the marked request it came from
+func parseMarkedRequest(raw string) (Request, error) {
+	if strings.Count(raw, injectionMarker)%2 != 0 {
+		return Request{}, errors.New("raw request has an unmatched " + injectionMarker + " injection marker")
+	}
+
+	request, err := parseRawRequest(strings.Replace(raw, injectionMarker, "", -1), "", rawRequestScheme())
+	if err != nil {
+		return request, err
+	}
+
+	if strings.Contains(raw, injectionMarker) {
+		request.markedRaw = raw
+	}
+	return request, nil
+}
+
+func rawRequestScheme() string {
+	if opts.PlainHttp {
+		return "http"
+	}
+	return "https"
+}
+
+// Each marked region is an injection point, named by its position in the request (starting from 1)
+func markerInjectionPoints(request Request) []injectionPoint {
+	parts := strings.Split(request.markedRaw, injectionMarker)
+
+	// Payloads are URL encoded within the request line and form bodies, so they can't break the request. Within the
+	// request line, payloads are path escaped before the query string (where + is a literal plus, rather than a space)
+	unmarked := strings.Replace(request.markedRaw, injectionMarker, "", -1)
+	requestLineEnd := strings.Index(unmarked, "\n")
+	requestLine := unmarked
+	if requestLineEnd != -1 {
+		requestLine = unmarked[:requestLineEnd]
+	}
+	queryStart := strings.Index(requestLine, "?")
+	bodyStart := len(unmarked) - len(request.Body)
+	isForm := strings.Contains(strings.ToLower(request.header("Content-Type")), "application/x-www-form-urlencoded")
+
+	var points []injectionPoint
+	offset := 0
+	for i := 1; i < len(parts); i += 2 {
+		// Offset of the marked region within the request without markers
+		offset += len(parts[i-1])
+		i := i
+		inRequestLine := requestLineEnd == -1 || offset < requestLineEnd
+		var encode func(string) string
+		if inRequestLine && !opts.DecodedParams {
+			encode = url.PathEscape
+			if queryStart != -1 && offset > queryStart {
+				encode = url.QueryEscape
+			}
+		} else if offset >= bodyStart && isForm {
+			encode = url.QueryEscape
+		}
+
+		points = append(points, injectionPoint{
+			Location:      "marker",
+			Name:          strconv.Itoa(len(points) + 1),
+			OriginalValue: parts[i],
+			inject: func(value string) Request {
+				if encode != nil {
+					value = encode(value)
+				}
+
+				injectedParts := make([]string, len(parts))
+				copy(injectedParts, parts)
+				injectedParts[i] = value
+
+				injected, err := parseRawRequest(strings.Join(injectedParts, ""), "", rawRequestScheme())
+				if err != nil {
+					// The request will fail to send, and be recorded as a failed request
+					return Request{Method: request.Method}
+				}
+				return injected
+			},
+		})
+		offset += len(parts[i])
+	}
+	return points
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMarkerInjectionPoints(t *testing.T) {
+	tests := []struct {
+		name           string
+		raw            string
+		originalValues []string
+		// The field of the injected request each marker is in, and its value after injecting into that marker
+		field    func(Request) string
+		injected []string
+	}{
+		{
+			"request line",
+			"GET /§a§/§b§?q=§c§&r=§§ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			[]string{"a", "b", "c", ""},
+			func(r Request) string { return r.Url },
+			[]string{
+				"https://example.com/x%20y+z%2F/b?q=c&r=",
+				"https://example.com/a/x%20y+z%2F?q=c&r=",
+				"https://example.com/a/b?q=x+y%2Bz%2F&r=",
+				"https://example.com/a/b?q=c&r=x+y%2Bz%2F",
+			},
+		},
+		{
+			// Values in headers are sent as they are
+			"headers",
+			"GET /?q=1 HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: §127.0.0.1§\r\nCookie: a=§1§; b=§2§\r\n\r\n",
+			[]string{"127.0.0.1", "1", "2"},
+			func(r Request) string { return r.Headers["X-Forwarded-For"] + " | " + r.Headers["Cookie"] },
+			[]string{"x y+z/ | a=1; b=2", "127.0.0.1 | a=x y+z/; b=2", "127.0.0.1 | a=1; b=x y+z/"},
+		},
+		{
+			"form body",
+			"POST /login HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\nuser=§admin§&pass=§x§",
+			[]string{"admin", "x"},
+			func(r Request) string { return r.Body },
+			[]string{"user=x+y%2Bz%2F&pass=x", "user=admin&pass=x+y%2Bz%2F"},
+		},
+		{
+			"JSON body",
+			"POST /login HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\n\r\n{\"user\":\"§admin§\"}",
+			[]string{"admin"},
+			func(r Request) string { return r.Body },
+			[]string{`{"user":"x y+z/"}`},
+		},
+		{
+			// Markers are only in the body of the request when they're after the headers, even if the same text is in both
+			"form body with the same text as a header",
+			"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\nX-Id: §id§\r\n\r\nid=§id§",
+			[]string{"id", "id"},
+			func(r Request) string { return r.Headers["X-Id"] + " | " + r.Body },
+			[]string{"x y+z/ | id=id", "id | id=x+y%2Bz%2F"},
+		},
+		{
+			// A ? after the request line doesn't start the query string
+			"question mark in a header",
+			"GET /§a§ HTTP/1.1\r\nHost: example.com\r\nReferer: https://example.com/?§b§\r\n\r\n",
+			[]string{"a", "b"},
+			func(r Request) string { return r.Url + " | " + r.Headers["Referer"] },
+			[]string{"https://example.com/x%20y+z%2F | https://example.com/?b", "https://example.com/a | https://example.com/?x y+z/"},
+		},
+	}
+
+	for _, test := range tests {
+		request, err := parseMarkedRequest(test.raw)
+		if err != nil {
+			t.Errorf("%v: parseMarkedRequest returned error: %v", test.name, err)
+			continue
+		}
+
+		var names, originalValues, injected []string
+		for _, point := range markerInjectionPoints(request) {
+			names = append(names, point.Name)
+			originalValues = append(originalValues, point.OriginalValue)
+			injected = append(injected, test.field(point.inject("x y+z/")))
+		}
+		var wantNames []string
+		for i := range test.originalValues {
+			wantNames = append(wantNames, strconv.Itoa(i+1))
+		}
+		if !reflect.DeepEqual(names, wantNames) || !reflect.DeepEqual(originalValues, test.originalValues) {
+			t.Errorf("%v: markers are %q, %q, want %q, %q", test.name, names, originalValues, wantNames, test.originalValues)
+		}
+		if !reflect.DeepEqual(injected, test.injected) {
+			t.Errorf("%v: injected requests are %q, want %q", test.name, injected, test.injected)
+		}
+	}
+}
+
+func TestParseMarkedRequest(t *testing.T) {
+	request, err := parseMarkedRequest("GET /?q=§1§ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Url != "https://example.com/?q=1" || request.markedRaw == "" {
+		t.Errorf("parseMarkedRequest = %v with the marked request %q", request.Url, request.markedRaw)
+	}
+
+	if _, err := parseMarkedRequest("GET /?q=§1 HTTP/1.1\r\nHost: example.com\r\n\r\n"); err == nil {
+		t.Errorf("parseMarkedRequest with an unmatched marker didn't return an error")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Contexts a reflection can land in. attribute can also be used in expectations, to match either kind of attribute
+var reflectionContexts = []string{"html", "tag", "quoted-attribute", "unquoted-attribute", "script", "style", "comment", "json"}
+
+// Characters reported when they're reflected without being encoded, if the payload contains them
+const reflectionSpecialCharacters = "\"'<>`&\\()/;="
+
+// Matches reflections of the task's token (from [[canary]] or [[random]]) in a particular context, optionally
+// requiring some of the payload's characters to be reflected without being encoded
+type ReflectionExpectation struct {
+	Contexts  []string `mapstructure:"contexts"`
+	Unencoded []string `mapstructure:"unencoded"`
+}
+
+// Where the token was reflected, and which of the payload's special characters around it survived unencoded
+type Reflection struct {
+	Context   string   `json:"context"`
+	Unencoded []string `json:"unencoded"`
+}
+
+func (r Reflection) String() string {
+	if len(r.Unencoded) == 0 {
+		return fmt.Sprintf("reflected in %v", r.Context)
+	}
+	return fmt.Sprintf("reflected in %v, unencoded: %v", r.Context, strings.Join(r.Unencoded, " "))
+}
+
+func (e *ReflectionExpectation) validate() error {
+	for _, context := range e.Contexts {
+		if context != "attribute" && !containsString(reflectionContexts, context) {
+			return fmt.Errorf("unsupported reflection context %v (expected attribute or one of: %v)", context, strings.Join(reflectionContexts, ", "))
+		}
+	}
+	for _, character := range e.Unencoded {
+		if utf8.RuneCountInString(character) != 1 {
+			return fmt.Errorf("invalid unencoded character %q (expected a single character)", character)
+		}
+	}
+	return nil
+}
+
+// Get the reflections that are in one of the expected contexts, with all of the expected characters unencoded
+func (e *ReflectionExpectation) matches(reflections []Reflection) []Reflection {
+	var matched []Reflection
+	for _, reflection := range reflections {
+		if len(e.Contexts) > 0 && !containsString(e.Contexts, reflection.Context) &&
+			!(containsString(e.Contexts, "attribute") && strings.HasSuffix(reflection.Context, "-attribute")) {
+			continue
+		}
+
+		unencoded := true
+		for _, character := range e.Unencoded {
+			if !containsString(reflection.Unencoded, character) {
+				unencoded = false
+			}
+		}
+		if unencoded {
+			matched = append(matched, reflection)
+		}
+	}
+	return matched
+}
+
+// Find each reflection of the token in the response body, and work out the context it was reflected in
+func analyzeReflections(resp Response, payload string, token string) []Reflection {
+	// Tokens are found regardless of case, as encoders such as mixedcase change it
+	tokenIndex := indexFold(payload, token, 0)
+	if token == "" || tokenIndex == -1 {
+		return nil
+	}
+	prefix, suffix := payload[:tokenIndex], payload[tokenIndex+len(token):]
+	isJson := strings.Contains(strings.ToLower(resp.Headers.Get("Content-Type")), "json")
+
+	var reflections []Reflection
+	body := resp.Body
+	for offset := 0; ; {
+		start := indexFold(body, token, offset)
+		if start == -1 {
+			break
+		}
+		end := start + len(token)
+		offset = end
+
+		prefixStart, prefixUnencoded := alignBackward(body, start, prefix)
+		_, suffixUnencoded := alignForward(body, end, suffix)
+
+		context := "json"
+		if !isJson {
+			// The context is where the payload started, as the characters before the token may have broken out of it
+			context = htmlContext(body[:prefixStart])
+		}
+
+		reflection := Reflection{Context: context, Unencoded: []string{}}
+		for _, character := range reflectionSpecialCharacters {
+			if prefixUnencoded[character] || suffixUnencoded[character] {
+				reflection.Unencoded = append(reflection.Unencoded, string(character))
+			}
+		}
+		reflections = append(reflections, reflection)
+	}
+	return reflections
+}
+
+// Find the first case insensitive match of an ASCII substring (such as a token), from the given offset
+func indexFold(value string, substring string, offset int) int {
+	for i := offset; i+len(substring) <= len(value); i++ {
+		if strings.EqualFold(value[i:i+len(substring)], substring) {
+			return i
+		}
+	}
+	return -1
+}
+
+// The longest encoding of a character, so only the part of the body that could contain one is compared
+const maxEncodingLength = 10
+
+// Ways a character is commonly encoded when it's reflected, checked before the character itself as some of them
+// (such as \") still contain it
+func characterEncodings(character rune) []string {
+	encodings := []string{
+		fmt.Sprintf("&#%d;", character),
+		fmt.Sprintf("&#x%x;", character),
+		fmt.Sprintf("&#x%02x;", character),
+		fmt.Sprintf("\\u%04x", character),
+		fmt.Sprintf("\\x%02x", character),
+		fmt.Sprintf("%%%02x", character),
+		"\\" + string(character),
+	}
+	entities := map[rune][]string{'"': {"&quot;"}, '\'': {"&apos;"}, '<': {"&lt;"}, '>': {"&gt;"}, '&': {"&amp;"}}
+	return append(entities[character], encodings...)
+}
+
+// Align the characters before the token in the payload with the body, working backward from the token. Returns
+// where the reflected payload starts, and which characters were reflected as-is
+func alignBackward(body string, position int, prefix string) (int, map[rune]bool) {
+	unencoded := make(map[rune]bool)
+	characters := []rune(prefix)
+	for i := len(characters) - 1; i >= 0; i-- {
+		character := characters[i]
+		windowStart := position - maxEncodingLength
+		if windowStart < 0 {
+			windowStart = 0
+		}
+		if encoding := matchingEncoding(body[windowStart:position], character, strings.HasSuffix); encoding != "" {
+			position -= len(encoding)
+		} else if strings.HasSuffix(body[:position], string(character)) {
+			unencoded[character] = true
+			position -= len(string(character))
+		}
+		// Otherwise the character was removed, so the next character is compared at the same position
+	}
+	return position, unencoded
+}
+
+// Align the characters after the token in the payload with the body, working forward from the token
+func alignForward(body string, position int, suffix string) (int, map[rune]bool) {
+	unencoded := make(map[rune]bool)
+	for _, character := range suffix {
+		windowEnd := position + maxEncodingLength
+		if windowEnd > len(body) {
+			windowEnd = len(body)
+		}
+		if encoding := matchingEncoding(body[position:windowEnd], character, strings.HasPrefix); encoding != "" {
+			position += len(encoding)
+		} else if strings.HasPrefix(body[position:], string(character)) {
+			unencoded[character] = true
+			position += len(string(character))
+		}
+	}
+	return position, unencoded
+}
+
+func matchingEncoding(body string, character rune, matches func(string, string) bool) string {
+	lowerBody := strings.ToLower(body)
+	for _, encoding := range characterEncodings(character) {
+		if matches(lowerBody, strings.ToLower(encoding)) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+const (
+	htmlStateText = iota
+	htmlStateTag
+	htmlStateQuotedAttribute
+	htmlStateUnquotedAttribute
+	htmlStateComment
+	htmlStateRawText
+)
+
+// Work out the context at the end of an HTML document, by following its tags, attributes and comments. This isn't
+// a complete HTML parser, but handles the cases that matter for reflections
+func htmlContext(document string) string {
+	lower := strings.ToLower(document)
+	state := htmlStateText
+	// The tag being parsed, and the element whose contents are raw text (script or style)
+	tagName, rawTextElement := "", ""
+	var quote byte
+
+	for i := 0; i < len(lower); i++ {
+		switch state {
+		case htmlStateText:
+			if strings.HasPrefix(lower[i:], "<!--") {
+				state = htmlStateComment
+				i += 3
+			} else if lower[i] == '<' && i+1 < len(lower) && (isLetter(lower[i+1]) || lower[i+1] == '/') {
+				tagName = readTagName(lower[i+1:])
+				state = htmlStateTag
+				i += len(tagName)
+			}
+		case htmlStateComment:
+			if strings.HasPrefix(lower[i:], "-->") {
+				state = htmlStateText
+				i += 2
+			}
+		case htmlStateRawText:
+			if closing := "</" + rawTextElement; strings.HasPrefix(lower[i:], closing) {
+				tagName = "/" + rawTextElement
+				state = htmlStateTag
+				i += len(closing) - 1
+			}
+		case htmlStateTag:
+			switch lower[i] {
+			case '>':
+				state = htmlStateText
+				if tagName == "script" || tagName == "style" {
+					rawTextElement = tagName
+					state = htmlStateRawText
+				}
+			case '=':
+				// Skip whitespace between the = and the value
+				for i+1 < len(lower) && isSpace(lower[i+1]) {
+					i++
+				}
+				if i+1 < len(lower) && (lower[i+1] == '"' || lower[i+1] == '\'') {
+					quote = lower[i+1]
+					state = htmlStateQuotedAttribute
+					i++
+				} else {
+					state = htmlStateUnquotedAttribute
+				}
+			}
+		case htmlStateQuotedAttribute:
+			if lower[i] == quote {
+				state = htmlStateTag
+			}
+		case htmlStateUnquotedAttribute:
+			if isSpace(lower[i]) {
+				state = htmlStateTag
+			} else if lower[i] == '>' {
+				state = htmlStateTag
+				i--
+			}
+		}
+	}
+
+	switch state {
+	case htmlStateTag:
+		return "tag"
+	case htmlStateQuotedAttribute:
+		return "quoted-attribute"
+	case htmlStateUnquotedAttribute:
+		return "unquoted-attribute"
+	case htmlStateComment:
+		return "comment"
+	case htmlStateRawText:
+		return rawTextElement
+	}
+	return "html"
+}
+
+func readTagName(document string) string {
+	end := 0
+	for end < len(document) && (isLetter(document[end]) || (document[end] >= '0' && document[end] <= '9') || (end == 0 && document[end] == '/')) {
+		end++
+	}
+	return document[:end]
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
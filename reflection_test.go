@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHtmlContext(t *testing.T) {
+	tests := []struct {
+		document string
+		context  string
+	}{
+		{``, "html"},
+		{`<p>`, "html"},
+		{`<p>hello `, "html"},
+		{`a < b `, "html"},
+		{`<h1>`, "html"},
+		{`<p`, "tag"},
+		{`<input `, "tag"},
+		{`</p`, "tag"},
+		{`</p>`, "html"},
+		{`<input value="x" `, "tag"},
+
+		{`<input value="`, "quoted-attribute"},
+		{`<input value='`, "quoted-attribute"},
+		{`<a href = "`, "quoted-attribute"},
+		{`<input value="a'`, "quoted-attribute"},
+		{`<input value="x>`, "quoted-attribute"},
+		{`<input value="<script>`, "quoted-attribute"},
+		{`<p title="a" data-x='b`, "quoted-attribute"},
+		{`<INPUT VALUE="`, "quoted-attribute"},
+
+		{`<p class=`, "unquoted-attribute"},
+		{`<input value=x`, "unquoted-attribute"},
+		{`<input value=x `, "tag"},
+		{`<p a=b>`, "html"},
+
+		{`<!-- `, "comment"},
+		{`<!-- <p title="`, "comment"},
+		{`<!-- x -->`, "html"},
+		{`<div><!-- <script> -->`, "html"},
+
+		{`<script>var a='`, "script"},
+		{`<SCRIPT>`, "script"},
+		{`<script src="a.js">`, "script"},
+		{`<script>var a = "<p title='`, "script"},
+		{`<script>var x = "</scr`, "script"},
+		{`<script>x</script>`, "html"},
+		// Script elements end at the closing tag, even inside a string
+		{`<script>var a = "</script>`, "html"},
+		{`<script2>`, "html"},
+		{`<style>body { color: `, "style"},
+		{`<style></style><p>`, "html"},
+	}
+
+	for _, test := range tests {
+		if context := htmlContext(test.document); context != test.context {
+			t.Errorf("htmlContext(%q) = %v, want %v", test.document, context, test.context)
+		}
+	}
+}
+
+func TestAlignBackward(t *testing.T) {
+	tests := []struct {
+		body      string
+		prefix    string
+		start     int
+		unencoded []rune
+	}{
+		{`">TOKEN`, `">`, 0, []rune{'"', '>'}},
+		{`<p>"><TOKEN`, `"><`, 3, []rune{'"', '>', '<'}},
+		{`&quot;&gt;TOKEN`, `">`, 0, nil},
+		{`\"&gt;TOKEN`, `">`, 0, nil},
+		{`&#X3C;TOKEN`, `<`, 0, nil},
+		{`%3CTOKEN`, `<`, 0, nil},
+		{`'TOKEN`, `'`, 0, []rune{'\''}},
+		// Removed characters are skipped, so the payload starts where the rest of it does
+		{`x>TOKEN`, `">`, 1, []rune{'>'}},
+		{`xTOKEN`, `">`, 1, nil},
+		{`TOKEN`, `"`, 0, nil},
+		{`&lt;TOKEN`, `x<`, 0, nil},
+		{`ü"TOKEN`, `ü"`, 0, []rune{'ü', '"'}},
+	}
+
+	for _, test := range tests {
+		position := len(test.body) - len("TOKEN")
+		start, unencoded := alignBackward(test.body, position, test.prefix)
+		if start != test.start || !sameRunes(unencoded, test.unencoded) {
+			t.Errorf("alignBackward(%q, %v, %q) = %v, %v, want %v, %q", test.body, position, test.prefix, start, unencoded, test.start, test.unencoded)
+		}
+	}
+}
+
+func TestAlignForward(t *testing.T) {
+	tests := []struct {
+		body      string
+		suffix    string
+		end       int
+		unencoded []rune
+	}{
+		{`TOKEN"><`, `"><`, 8, []rune{'"', '>', '<'}},
+		{`TOKEN&quot;&gt;&lt;`, `"><`, 19, nil},
+		{`TOKEN\u003c`, `<`, 11, nil},
+		{`TOKEN&#60;/p>`, `</p>`, 13, []rune{'/', 'p', '>'}},
+		{`TOKEN"'`, `'"`, 6, []rune{'"'}},
+		{`TOKEN`, `"`, 5, nil},
+		// Encodings are only matched right after the token
+		{`TOKENx&quot;`, `"`, 5, nil},
+	}
+
+	for _, test := range tests {
+		end, unencoded := alignForward(test.body, len("TOKEN"), test.suffix)
+		if end != test.end || !sameRunes(unencoded, test.unencoded) {
+			t.Errorf("alignForward(%q, 5, %q) = %v, %v, want %v, %q", test.body, test.suffix, end, unencoded, test.end, test.unencoded)
+		}
+	}
+}
+
+func sameRunes(set map[rune]bool, runes []rune) bool {
+	if len(set) != len(runes) {
+		return false
+	}
+	for _, r := range runes {
+		if !set[r] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAnalyzeReflections(t *testing.T) {
+	html := http.Header{"Content-Type": []string{"text/html"}}
+	tests := []struct {
+		body        string
+		headers     http.Header
+		payload     string
+		reflections []Reflection
+	}{
+		{`<p>"><tok</p>`, html, `"><tok`, []Reflection{{"html", []string{"\"", "<", ">"}}}},
+		{`<input value="&quot;&gt;&lt;tok">`, html, `"><tok`, []Reflection{{"quoted-attribute", []string{}}}},
+		{`<input value=""><tok">`, html, `"><tok`, []Reflection{{"quoted-attribute", []string{"\"", "<", ">"}}}},
+		{`<script>var a = '';TOK//';</script>`, html, `';tok//`, []Reflection{{"script", []string{"'", "/", ";"}}}},
+		{`<!-- tok --><p>tok</p>`, html, `tok`, []Reflection{{"comment", []string{}}, {"html", []string{}}}},
+		{`{"q":"\"tok"}`, http.Header{"Content-Type": []string{"application/json"}}, `"tok`, []Reflection{{"json", []string{}}}},
+		{`<p>nothing</p>`, html, `"><tok`, nil},
+		{`<p>tok</p>`, html, `"><script>`, nil},
+	}
+
+	for _, test := range tests {
+		resp := Response{Body: test.body, Headers: test.headers}
+		reflections := analyzeReflections(resp, test.payload, "tok")
+		if !reflect.DeepEqual(reflections, test.reflections) {
+			t.Errorf("analyzeReflections(%q, %q) = %v, want %v", test.body, test.payload, reflections, test.reflections)
+		}
+	}
+}
+
+func TestReflectionExpectationMatches(t *testing.T) {
+	reflections := []Reflection{
+		{"quoted-attribute", []string{"\""}},
+		{"html", []string{"<", ">"}},
+		{"script", []string{}},
+	}
+	tests := []struct {
+		expectation ReflectionExpectation
+		contexts    []string
+	}{
+		{ReflectionExpectation{}, []string{"quoted-attribute", "html", "script"}},
+		{ReflectionExpectation{Contexts: []string{"attribute"}}, []string{"quoted-attribute"}},
+		{ReflectionExpectation{Contexts: []string{"unquoted-attribute"}}, nil},
+		{ReflectionExpectation{Unencoded: []string{"<"}}, []string{"html"}},
+		{ReflectionExpectation{Contexts: []string{"html", "script"}, Unencoded: []string{"<", ">"}}, []string{"html"}},
+		{ReflectionExpectation{Unencoded: []string{"\"", "<"}}, nil},
+	}
+
+	for _, test := range tests {
+		var contexts []string
+		for _, reflection := range test.expectation.matches(reflections) {
+			contexts = append(contexts, reflection.Context)
+		}
+		if !reflect.DeepEqual(contexts, test.contexts) {
+			t.Errorf("%+v matched %v, want %v", test.expectation, contexts, test.contexts)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response bodies are truncated to this many bytes in HTML reports, centred around the first matched content
+const maxEvidenceBodyLength = 8192
+
+type Evidence struct {
+	Injected   ExchangeEvidence
+	Baseline   *ExchangeEvidence
+	Heuristics *ExchangeEvidence
+}
+
+// A request, along with the headers that were sent with it, and its response
+type ExchangeEvidence struct {
+	Request        Request
+	RequestHeaders http.Header
+	Response       ResponseEvidence
+}
+
+type ResponseEvidence struct {
+	StatusCode     int
+	StatusMatched  bool
+	Headers        []headerEvidence
+	Body           []bodySegment
+	BodyTruncated  bool
+	OriginalLength int
+	Duration       time.Duration
+}
+
+type headerEvidence struct {
+	Name    string
+	Value   string
+	Matched bool
+}
+
+// Bodies are split into segments, so matched content can be highlighted while html/template escapes everything
+type bodySegment struct {
+	Text    string
+	Matched bool
+}
+
+func newEvidence(t Task, resp Response, baselineResponse Response, heuristicsResponse Response) *Evidence {
+	evidence := &Evidence{
+		Injected: ExchangeEvidence{
+			Request:        t.Injection.Injected,
+			RequestHeaders: resp.RequestHeaders,
+			Response:       newResponseEvidence(resp, &t.RuleData.Expectation),
+		},
+	}
+
+	if t.RuleData.Heuristics.Injection != "" {
+		evidence.Baseline = &ExchangeEvidence{
+			Request:        t.Injection.Baseline,
+			RequestHeaders: baselineResponse.RequestHeaders,
+			Response:       newResponseEvidence(baselineResponse, nil),
+		}
+		evidence.Heuristics = &ExchangeEvidence{
+			Request:        t.Injection.Heuristics,
+			RequestHeaders: heuristicsResponse.RequestHeaders,
+			Response:       newResponseEvidence(heuristicsResponse, nil),
+		}
+	}
+	return evidence
+}
+
+// Build the evidence for a response, highlighting what matched the expectation (if provided)
+func newResponseEvidence(resp Response, expectation *ExpectedResponse) ResponseEvidence {
+	evidence := ResponseEvidence{StatusCode: resp.StatusCode, OriginalLength: len(resp.Body), Duration: resp.Duration}
+
+	var matchRanges [][]int
+	if expectation != nil {
+		matchRanges = expectation.contentMatchRanges(resp.Body)
+		for _, code := range expectation.Codes {
+			if statusCode, err := strconv.Atoi(code); err == nil && statusCode == resp.StatusCode {
+				evidence.StatusMatched = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(resp.Headers))
+	for name := range resp.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header := headerEvidence{Name: name, Value: strings.Join(resp.Headers[name], ", ")}
+		if expectation != nil {
+			header.Matched = expectation.headersMatch(http.Header{name: resp.Headers[name]})
+		}
+		evidence.Headers = append(evidence.Headers, header)
+	}
+
+	start, end := 0, len(resp.Body)
+	if end > maxEvidenceBodyLength {
+		evidence.BodyTruncated = true
+		if len(matchRanges) > 0 {
+			start = firstMatchStart(matchRanges) - maxEvidenceBodyLength/2
+			if start < 0 {
+				start = 0
+			}
+		}
+		end = start + maxEvidenceBodyLength
+		if end > len(resp.Body) {
+			end = len(resp.Body)
+			start = end - maxEvidenceBodyLength
+		}
+	}
+	evidence.Body = highlightSegments(resp.Body[start:end], start, matchRanges)
+	return evidence
+}
+
+func firstMatchStart(matchRanges [][]int) int {
+	first := matchRanges[0][0]
+	for _, match := range matchRanges {
+		if match[0] < first {
+			first = match[0]
+		}
+	}
+	return first
+}
+
+// Split the (possibly truncated) body into plain and highlighted segments. offset is where the body starts within
+// the original response body, which the match ranges are relative to
+func highlightSegments(body string, offset int, matchRanges [][]int) []bodySegment {
+	highlighted := make([]bool, len(body))
+	for _, match := range matchRanges {
+		for i := match[0] - offset; i < match[1]-offset; i++ {
+			if i >= 0 && i < len(body) {
+				highlighted[i] = true
+			}
+		}
+	}
+
+	var segments []bodySegment
+	for i := 0; i < len(body); {
+		j := i
+		for j < len(body) && highlighted[j] == highlighted[i] {
+			j++
+		}
+		segments = append(segments, bodySegment{Text: body[i:j], Matched: highlighted[i]})
+		i = j
+	}
+	return segments
+}
+
+type reportRule struct {
+	Name        string
+	Description string
+	Severity    string
+	Hosts       []reportHost
+	Count       int
+}
+
+type reportHost struct {
+	Host    string
+	Results []EvaluationResult
+}
+
+func writeHtmlReport(w io.Writer, results []EvaluationResult) error {
+	grouped := make(map[string]map[string][]EvaluationResult)
+	for _, result := range results {
+		host := result.InjectedUrl
+		if u, err := url.Parse(result.InjectedUrl); err == nil {
+			host = u.Host
+		}
+		if grouped[result.RuleName] == nil {
+			grouped[result.RuleName] = make(map[string][]EvaluationResult)
+		}
+		grouped[result.RuleName][host] = append(grouped[result.RuleName][host], result)
+	}
+
+	var rules []reportRule
+	for ruleName, hosts := range grouped {
+		rule := reportRule{Name: ruleName, Description: config.Rules[ruleName].Description, Severity: config.Rules[ruleName].Severity}
+		for host, hostResults := range hosts {
+			rule.Hosts = append(rule.Hosts, reportHost{Host: host, Results: hostResults})
+			rule.Count += len(hostResults)
+		}
+		sort.Slice(rule.Hosts, func(i, j int) bool { return rule.Hosts[i].Host < rule.Hosts[j].Host })
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	return reportTemplate.Execute(w, map[string]interface{}{
+		"Version":   Version,
+		"Generated": time.Now().Format(time.RFC1123),
+		"Total":     len(results),
+		"Rules":     rules,
+	})
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>qsfuzz report</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #24292e; }
+h1 { margin-bottom: 0; }
+.meta { color: #6a737d; margin-bottom: 2em; }
+.rule { border: 1px solid #d1d5da; border-radius: 6px; margin-bottom: 2em; padding: 0 1em 1em 1em; }
+.severity { font-size: 0.8em; text-transform: uppercase; padding: 0.2em 0.5em; border-radius: 4px; background: #e1e4e8; }
+.severity.critical, .severity.high { background: #d73a49; color: #fff; }
+.severity.medium { background: #f66a0a; color: #fff; }
+.finding { border-top: 1px solid #e1e4e8; padding: 0.5em 0; }
+.finding summary { cursor: pointer; font-family: monospace; word-break: break-all; }
+.columns { display: flex; gap: 1em; flex-wrap: wrap; }
+.columns > div { flex: 1; min-width: 30em; }
+pre { background: #f6f8fa; padding: 0.75em; overflow-x: auto; white-space: pre-wrap; word-break: break-all; max-height: 40em; }
+mark { background: #ffdf5d; }
+table { border-collapse: collapse; font-family: monospace; font-size: 0.9em; }
+td { border: 1px solid #e1e4e8; padding: 0.2em 0.5em; vertical-align: top; word-break: break-all; }
+tr.matched td { background: #ffdf5d; }
+.status.matched { background: #ffdf5d; }
+</style>
+</head>
+<body>
+<h1>qsfuzz report</h1>
+<div class="meta">{{.Total}} positive match(es), generated {{.Generated}} by qsfuzz {{.Version}}</div>
+{{range .Rules}}
+<div class="rule">
+<h2>{{.Name}} {{if .Severity}}<span class="severity {{.Severity}}">{{.Severity}}</span>{{end}}</h2>
+<p>{{.Description}} ({{.Count}} match(es))</p>
+{{range .Hosts}}
+<h3>{{.Host}}</h3>
+{{range .Results}}
+<div class="finding">
+<details>
+<summary>{{.Method}} {{.InjectedUrl}}</summary>
+<p>Injected <code>{{.Payload}}</code>{{if .Encoders}} (encoded with <code>{{.Encoders}}</code>){{end}} into {{.Location}} <code>{{.Parameter}}</code>, matching {{join .MatchedChecks ", "}} at {{.Timestamp.Format "2006-01-02 15:04:05 MST"}}</p>
+{{range .Reflections}}<p>Reflected in {{.Context}}{{if .Unencoded}}, unencoded: <code>{{join .Unencoded " "}}</code>{{end}}</p>{{end}}
+{{with .Interaction}}<p>Out-of-band {{.Protocol}} interaction from <code>{{.RemoteAddr}}</code>: <code>{{.Data}}</code></p>{{end}}
+{{with .Evidence}}
+{{template "exchange" .Injected}}
+{{if .Baseline}}
+<div class="columns">
+<div>
+<h4>Baseline</h4>
+{{template "exchange" .Baseline}}
+</div>
+<div>
+<h4>Heuristics</h4>
+{{template "exchange" .Heuristics}}
+</div>
+</div>
+{{end}}
+{{end}}
+</details>
+</div>
+{{end}}
+{{end}}
+</div>
+{{else}}
+<p>No positive matches were found.</p>
+{{end}}
+</body>
+</html>
+{{define "exchange"}}<pre>{{.Request.Method}} {{.Request.Url}}
+{{range $name, $values := .RequestHeaders}}{{$name}}: {{join $values ", "}}
+{{end}}{{if .Request.Body}}
+{{.Request.Body}}{{end}}</pre>
+{{with .Response}}<p><span class="status{{if .StatusMatched}} matched{{end}}">Status {{.StatusCode}}</span>, {{.OriginalLength}} bytes in {{.Duration}}{{if .BodyTruncated}} (body truncated){{end}}</p>
+{{if .Headers}}<table>{{range .Headers}}<tr{{if .Matched}} class="matched"{{end}}><td>{{.Name}}</td><td>{{.Value}}</td></tr>{{end}}</table>{{end}}
+<pre>{{range .Body}}{{if .Matched}}<mark>{{.Text}}</mark>{{else}}{{.Text}}{{end}}{{end}}</pre>{{end}}{{end}}
+`))
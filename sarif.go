@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Only the parts of SARIF 2.1.0 that qsfuzz uses are defined here
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationUri string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	Id                   string                 `json:"id"`
+	Name                 string                 `json:"name"`
+	ShortDescription     sarifMessage           `json:"shortDescription"`
+	FullDescription      sarifMessage           `json:"fullDescription"`
+	DefaultConfiguration sarifConfiguration     `json:"defaultConfiguration"`
+	Properties           map[string]interface{} `json:"properties"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleId     string                 `json:"ruleId"`
+	RuleIndex  int                    `json:"ruleIndex"`
+	Level      string                 `json:"level"`
+	Message    sarifMessage           `json:"message"`
+	Locations  []sarifLocation        `json:"locations"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	Uri string `json:"uri"`
+}
+
+var severities = []string{"critical", "high", "medium", "low", "info"}
+
+// Map rule severities to SARIF levels, along with the security-severity scores used by code scanning dashboards
+func sarifSeverity(severity string) (string, string) {
+	switch severity {
+	case "critical":
+		return "error", "9.5"
+	case "high":
+		return "error", "8.0"
+	case "low":
+		return "note", "3.0"
+	case "info":
+		return "note", "0.0"
+	default:
+		return "warning", "5.5"
+	}
+}
+
+func writeSarif(w io.Writer, results []EvaluationResult) error {
+	ruleNames := make([]string, 0, len(config.Rules))
+	for ruleName := range config.Rules {
+		ruleNames = append(ruleNames, ruleName)
+	}
+	sort.Strings(ruleNames)
+
+	driver := sarifDriver{Name: "qsfuzz", Version: Version, InformationUri: "https://github.com/ameenmaali/qsfuzz"}
+	ruleIndexes := make(map[string]int)
+	for index, ruleName := range ruleNames {
+		rule := config.Rules[ruleName]
+		level, securitySeverity := sarifSeverity(rule.Severity)
+		tags := rule.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+
+		driver.Rules = append(driver.Rules, sarifRule{
+			Id:                   ruleName,
+			Name:                 ruleName,
+			ShortDescription:     sarifMessage{Text: rule.Description},
+			FullDescription:      sarifMessage{Text: rule.Description},
+			DefaultConfiguration: sarifConfiguration{Level: level},
+			Properties: map[string]interface{}{
+				"tags":              append([]string{"security"}, tags...),
+				"security-severity": securitySeverity,
+			},
+		})
+		ruleIndexes[ruleName] = index
+	}
+
+	run := sarifRun{Tool: sarifTool{Driver: driver}, Results: []sarifResult{}}
+	for _, result := range results {
+		level, _ := sarifSeverity(config.Rules[result.RuleName].Severity)
+		properties := map[string]interface{}{
+			"location":      result.Location,
+			"parameter":     result.Parameter,
+			"payload":       result.Payload,
+			"method":        result.Method,
+			"statusCode":    result.StatusCode,
+			"matchedChecks": result.MatchedChecks,
+			"timestamp":     result.Timestamp,
+		}
+		if result.InjectedBody != "" {
+			properties["injectedBody"] = result.InjectedBody
+		}
+		if result.Encoders != "" {
+			properties["encoders"] = result.Encoders
+		}
+		if len(result.Reflections) > 0 {
+			properties["reflections"] = result.Reflections
+		}
+		if result.Interaction != nil {
+			properties["interaction"] = result.Interaction
+		}
+
+		run.Results = append(run.Results, sarifResult{
+			RuleId:    result.RuleName,
+			RuleIndex: ruleIndexes[result.RuleName],
+			Level:     level,
+			Message: sarifMessage{
+				Text: fmt.Sprintf("%v: injecting %q into %v %v matched %v", result.RuleDescription, result.Payload, result.Location, result.Parameter, result.MatchedChecks),
+			},
+			Locations: []sarifLocation{
+				{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{Uri: result.InjectedUrl}}},
+			},
+			Properties: properties,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
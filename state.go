@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Completed tasks are recorded in the state file (one JSON object per line) as they finish, so an interrupted scan
+// can be resumed by skipping them
+type ScanState struct {
+	mutex sync.Mutex
+	file  *os.File
+	// Tasks completed by previous runs
+	completed map[string]bool
+	// The number of tasks completed by this run
+	completedNow int
+}
+
+type completedTask struct {
+	Rule      string `json:"rule"`
+	Request   string `json:"request"`
+	Location  string `json:"location"`
+	Parameter string `json:"parameter"`
+	Payload   string `json:"payload"`
+	Encoders  string `json:"encoders,omitempty"`
+}
+
+var scanState = &ScanState{completed: make(map[string]bool)}
+
+// Closed when the scan is interrupted, after which no new tasks are started
+var interrupted = make(chan struct{})
+
+// Load the tasks completed by previous runs, and open the state file to record more
+func openState(path string) (*ScanState, error) {
+	state := &ScanState{completed: make(map[string]bool)}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var task completedTask
+		// The last line may have only been partially written if qsfuzz was killed, so skip any invalid lines
+		if err := json.Unmarshal(scanner.Bytes(), &task); err != nil {
+			continue
+		}
+		state.completed[task.key()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	state.file = file
+	return state, nil
+}
+
+func newCompletedTask(t Task) completedTask {
+	// Tokens are different every run, so they're left out for the task to be recognised when resuming. The payload is
+	// recorded before it's encoded, as encoders (such as base64) change the token along with the rest of the payload
+	payload := t.Injection.UnencodedPayload
+	if t.Injection.Token != "" {
+		payload = strings.Replace(payload, t.Injection.Token, "[[token]]", -1)
+	}
+
+	return completedTask{
+		Rule:      t.RuleName,
+		Request:   t.Injection.Baseline.String(),
+		Location:  t.Injection.Location,
+		Parameter: t.Injection.Parameter,
+		Payload:   payload,
+		Encoders:  t.Injection.Encoders,
+	}
+}
+
+func (c completedTask) key() string {
+	return strings.Join([]string{c.Rule, c.Request, c.Location, c.Parameter, c.Payload, c.Encoders}, "\x00")
+}
+
+func (s *ScanState) isComplete(t Task) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.completed[newCompletedTask(t).key()]
+}
+
+// Record a completed task. Each task is written straight away, so it isn't lost if qsfuzz is killed
+func (s *ScanState) complete(t Task) error {
+	task := newCompletedTask(t)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Tasks are only ever sent once per run, so only tasks from previous runs need to be remembered
+	s.completedNow += 1
+	if s.file == nil {
+		return nil
+	}
+
+	line, err := encodeJson(task)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(s.file, line)
+	return err
+}
+
+func (s *ScanState) completedByThisRun() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.completedNow
+}
+
+func (s *ScanState) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+// On the first interrupt, stop starting new tasks so the workers can finish the ones in progress. A second interrupt
+// exits straight away
+func handleInterrupts() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		printRed(os.Stderr, "Interrupted, waiting for tasks in progress to finish (interrupt again to exit immediately)\n")
+		close(interrupted)
+
+		<-signals
+		scanState.close()
+		os.Exit(1)
+	}()
+}
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
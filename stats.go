@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets. Responses slower than the last bound are counted in a final bucket
+var latencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Only the busiest hosts are included in the summary, as input files can contain thousands of them
+const maxSummaryHosts = 20
+
+type requestCounts struct {
+	Requests int
+	Failed   int
+	Matches  int
+	// Tasks that were given up on before they could be evaluated
+	Incomplete int
+}
+
+// Stats are recorded by every worker, so all access goes through the mutex
+type Stats struct {
+	mutex      sync.Mutex
+	start      time.Time
+	successful int
+	failed     int
+	// Unique requests read from the input
+	inputs      int
+	rules       map[string]*requestCounts
+	hosts       map[string]*requestCounts
+	statusCodes map[int]int
+	errors      map[string]int
+	latencies   []int
+}
+
+var stats = newStats()
+
+func newStats() *Stats {
+	return &Stats{
+		start:       time.Now(),
+		rules:       make(map[string]*requestCounts),
+		hosts:       make(map[string]*requestCounts),
+		statusCodes: make(map[int]int),
+		errors:      make(map[string]int),
+		latencies:   make([]int, len(latencyBuckets)+1),
+	}
+}
+
+// Record a request sent for a rule, returning the total number of requests sent so far
+func (s *Stats) recordRequest(ruleName string, r Request, resp Response, err error) int {
+	host := r.Url
+	if u, parseErr := url.Parse(r.Url); parseErr == nil {
+		host = u.Host
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rule := s.counts(s.rules, ruleName)
+	hostCounts := s.counts(s.hosts, host)
+	rule.Requests += 1
+	hostCounts.Requests += 1
+
+	if err != nil {
+		s.failed += 1
+		rule.Failed += 1
+		hostCounts.Failed += 1
+		s.errors[classifyError(err)] += 1
+		return s.successful + s.failed
+	}
+
+	s.successful += 1
+	s.statusCodes[resp.StatusCode] += 1
+	bucket := sort.Search(len(latencyBuckets), func(i int) bool { return resp.Duration < latencyBuckets[i] })
+	s.latencies[bucket] += 1
+	return s.successful + s.failed
+}
+
+func (s *Stats) recordInput() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inputs += 1
+}
+
+func (s *Stats) inputsRead() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inputs
+}
+
+func (s *Stats) recordMatch(ruleName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counts(s.rules, ruleName).Matches += 1
+}
+
+func (s *Stats) recordIncomplete(ruleName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counts(s.rules, ruleName).Incomplete += 1
+}
+
+func (s *Stats) counts(m map[string]*requestCounts, key string) *requestCounts {
+	counts, ok := m[key]
+	if !ok {
+		counts = &requestCounts{}
+		m[key] = counts
+	}
+	return counts
+}
+
+func (s *Stats) requestsSent() (successful int, failed int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.successful, s.failed
+}
+
+func (s *Stats) requestsPerSecond() int {
+	successful, _ := s.requestsSent()
+	return int(float64(successful) / time.Since(s.start).Seconds())
+}
+
+// Categorize request errors, so failures can be summarized (and retried) by their cause
+func classifyError(err error) string {
+	var throttledErr *ThrottledError
+	if errors.As(err, &throttledErr) {
+		return "throttled"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+
+	var recordErr tls.RecordHeaderError
+	var certErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) || errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return "tls"
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "connection reset") {
+		return "reset"
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "refused"
+	}
+	return "other"
+}
+
+// Print a summary of everything sent, so scan coverage can be judged
+func (s *Stats) printSummary(out io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var rules [][]interface{}
+	for _, name := range sortedByRequests(s.rules) {
+		counts := s.rules[name]
+		rules = append(rules, []interface{}{name, counts.Requests, counts.Failed, counts.Matches, counts.Incomplete})
+	}
+	printTable(out, []interface{}{"RULE", "REQUESTS", "FAILED", "MATCHES", "INCOMPLETE"}, rules)
+
+	var hosts [][]interface{}
+	for _, host := range sortedByRequests(s.hosts) {
+		counts := s.hosts[host]
+		hosts = append(hosts, []interface{}{host, counts.Requests, counts.Failed})
+	}
+	if len(hosts) > maxSummaryHosts {
+		hosts = append(hosts[:maxSummaryHosts], []interface{}{fmt.Sprintf("(%v more)", len(hosts)-maxSummaryHosts)})
+	}
+	printTable(out, []interface{}{"HOST", "REQUESTS", "FAILED"}, hosts)
+
+	codes := make([]int, 0, len(s.statusCodes))
+	for code := range s.statusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	var statusCodes [][]interface{}
+	for _, code := range codes {
+		statusCodes = append(statusCodes, []interface{}{code, s.statusCodes[code]})
+	}
+	printTable(out, []interface{}{"STATUS", "RESPONSES"}, statusCodes)
+
+	if len(s.errors) > 0 {
+		categories := make([]string, 0, len(s.errors))
+		for category := range s.errors {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		var errorCounts [][]interface{}
+		for _, category := range categories {
+			errorCounts = append(errorCounts, []interface{}{category, s.errors[category]})
+		}
+		printTable(out, []interface{}{"ERROR", "REQUESTS"}, errorCounts)
+	}
+
+	var latencies [][]interface{}
+	for i, count := range s.latencies {
+		if i < len(latencyBuckets) {
+			latencies = append(latencies, []interface{}{"< " + latencyBuckets[i].String(), count})
+		} else {
+			latencies = append(latencies, []interface{}{">= " + latencyBuckets[i-1].String(), count})
+		}
+	}
+	printTable(out, []interface{}{"LATENCY", "RESPONSES"}, latencies)
+}
+
+func printTable(out io.Writer, header []interface{}, rows [][]interface{}) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w)
+	for _, row := range append([][]interface{}{header}, rows...) {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = fmt.Sprint(cell)
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+}
+
+func sortedByRequests(m map[string]*requestCounts) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]].Requests != m[keys[j]].Requests {
+			return m[keys[i]].Requests > m[keys[j]].Requests
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ThrottlingConfig struct {
+	// Response codes which mean a host is throttling requests
+	Codes []string `mapstructure:"codes"`
+	// Regexes matched against response bodies to detect WAF or rate limit block pages. There are none by default, as
+	// payloads are often blocked by WAFs themselves, which shouldn't pause the host
+	Signatures []string `mapstructure:"signatures"`
+	// The number of times a task is retried, and the number of times in a row a host can throttle requests before
+	// it's abandoned. A pointer, so 0 (no retries) can be told apart from it not being set
+	MaxRetries *int `mapstructure:"maxRetries"`
+
+	codes      []int
+	signatures []*regexp.Regexp
+	maxRetries int
+}
+
+// Only 429 by default, as other codes (such as 503) are also how hosts react to payloads, which rules need to match
+var defaultThrottlingCodes = []string{"429"}
+
+const defaultThrottlingRetries = 5
+
+// When a host without a -host-rate throttles requests, it's limited to this many requests per second. Each time it
+// throttles requests again the rate is halved, down to the minimum
+const throttledHostRate = 2.0
+const minThrottledHostRate = 0.1
+
+// How long a host is paused for when it doesn't send a Retry-After header, doubled each time in a row it throttles
+// requests, up to the maximum. Retry-After values are also capped to the maximum
+const throttlingPause = 5 * time.Second
+const maxThrottlingPause = 5 * time.Minute
+
+var errHostAbandoned = errors.New("host was abandoned after throttling too many requests")
+
+type ThrottledError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%v is throttling requests, paused until %v", e.Host, e.Until.Format("15:04:05"))
+}
+
+func (c *ThrottlingConfig) compile() error {
+	if c.Codes == nil {
+		c.Codes = defaultThrottlingCodes
+	}
+	c.maxRetries = defaultThrottlingRetries
+	if c.MaxRetries != nil {
+		c.maxRetries = *c.MaxRetries
+	}
+	if c.maxRetries < 0 {
+		return errors.New("throttling maxRetries cannot be negative")
+	}
+
+	c.codes = nil
+	for _, code := range c.Codes {
+		statusCode, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("invalid throttling code %q: must be a status code", code)
+		}
+		c.codes = append(c.codes, statusCode)
+	}
+
+	c.signatures = nil
+	for _, pattern := range c.Signatures {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid throttling signature %q: %v", pattern, err)
+		}
+		c.signatures = append(c.signatures, re)
+	}
+	return nil
+}
+
+// Responses are throttled if they have one of the throttling codes, or are a 503 with a Retry-After header (which
+// hosts send when they're overloaded, rather than because of a payload)
+func (c *ThrottlingConfig) isThrottled(resp Response) bool {
+	if resp.StatusCode == http.StatusServiceUnavailable && resp.Headers.Get("Retry-After") != "" {
+		return true
+	}
+	for _, code := range c.codes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+
+	for _, re := range c.signatures {
+		if re.MatchString(resp.Body) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get how long the host asked to be left alone for, from a Retry-After header of either seconds or a date
+func retryAfter(headers http.Header) time.Duration {
+	value := strings.TrimSpace(headers.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -2,120 +2,262 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"net/url"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func getUrlsFromFile() ([]string, error) {
-	deduplicatedUrls := make(map[string]bool)
-	var urls []string
+// Read requests from the input as they arrive, sending each unique request to be injected. Requests are deduplicated on
+// the fly, so this can be used at the end of a pipeline
+func readRequests(input io.Reader, requests chan<- Request) error {
+	deduplicatedRequests := newDedupeSet(opts.DedupeSize)
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		providedUrl := scanner.Text()
-		// Only include properly formatted URLs
-		u, err := url.Parse(providedUrl)
+	emit := func(request Request) {
+		u, err := url.Parse(request.Url)
 		if err != nil {
-			continue
+			return
 		}
 
 		queryStrings := u.Query()
+		bodyParams := bodyParamNames(request)
 
-		// Only include URLs that have query strings unless extra params are provided
-		if len(queryStrings) == 0 && !config.HasExtraParams {
-			continue
+		// Only include URLs that have query strings (or body parameters, or parameters declared by an OpenAPI document)
+		// unless extra params are provided, or rules inject into other parts of the request
+		if len(queryStrings) == 0 && len(bodyParams) == 0 && len(request.declaredPoints) == 0 && !config.HasExtraParams && !config.InjectsWithoutParams {
+			if opts.Debug {
+				printRed(os.Stderr, "skipping %v %v: no parameters to inject into\n", request.Method, request.Url)
+			}
+			return
 		}
 
-		// Use query string keys when sorting in order to get unique URL & Query String combinations
-		params := make([]string, 0)
-		for param, _ := range queryStrings {
-			params = append(params, param)
+		// When injecting into paths, paths that only differ by IDs are considered the same
+		path := u.EscapedPath()
+		if config.InjectsPath {
+			path = normalisePath(path)
 		}
-		sort.Strings(params)
 
-		key := fmt.Sprintf("%s%s?%s", u.Hostname(), u.EscapedPath(), strings.Join(params, "&"))
+		// Use query string and body parameter keys when sorting in order to get unique URL & parameter combinations
+		key := fmt.Sprintf("%s %s%s?%s %s", request.Method, u.Hostname(), path, strings.Join(sortedParams(queryStrings), "&"), strings.Join(bodyParams, "&"))
 
-		// Only output each host + path + params combination once, regardless if different param values
-		if _, exists := deduplicatedUrls[key]; exists {
+		// Only output each method + host + path + params combination once, regardless if different param values
+		if !deduplicatedRequests.add(key) {
+			return
+		}
+
+		request.Url = u.String()
+		stats.recordInput()
+		requests <- request
+	}
+
+	switch opts.InputFormat {
+	case "burp":
+		return readBurpRequests(input, emit)
+	case "har":
+		return readHarRequests(input, emit)
+	case "openapi":
+		return readOpenApiRequests(input, emit)
+	default:
+		return readRequestLines(input, emit)
+	}
+}
+
+func readRequestLines(input io.Reader, emit func(Request)) error {
+	scanner := bufio.NewScanner(input)
+	// Allow for long lines, such as JSON requests with large bodies
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		// Only include properly formatted URLs/requests
+		request, err := parseRequestLine(scanner.Text())
+		if err != nil {
+			if opts.Debug {
+				printRed(os.Stderr, "error parsing input line %v: %v\n", scanner.Text(), err)
+			}
 			continue
 		}
-		deduplicatedUrls[key] = true
+		emit(request)
+	}
+	return scanner.Err()
+}
+
+// Input lines can be a URL (sent as a GET request), a method, URL and optional form body separated by spaces
+// (i.e. "POST https://x/y a=1&b=2"), or a JSON object with method, url, headers and body keys
+func parseRequestLine(line string) (Request, error) {
+	request := Request{Method: "GET"}
+	line = strings.TrimSpace(line)
+
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			return request, err
+		}
+		if request.Method == "" {
+			request.Method = "GET"
+		}
+		request.Method = strings.ToUpper(request.Method)
+		return request, nil
+	}
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) > 1 && isHttpMethod(parts[0]) {
+		request.Method = parts[0]
+		request.Url = parts[1]
+		if len(parts) == 3 {
+			request.Body = strings.TrimSpace(parts[2])
+		}
+		return request, nil
+	}
+
+	request.Url = line
+	return request, nil
+}
 
-		urls = append(urls, u.String())
+func isHttpMethod(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
 	}
-	return urls, scanner.Err()
+	return true
 }
 
-func getInjectedUrls(u *url.URL, rule Rule) ([]UrlInjection, error) {
-	// If query strings can't be parsed, set query strings as empty
-	queryStrings, err := url.ParseQuery(u.RawQuery)
+func getInjectedRequests(request Request, rule Rule) ([]RequestInjection, error) {
+	u, err := url.Parse(request.Url)
 	if err != nil {
 		return nil, err
 	}
 
-	var urlInjections []UrlInjection
+	var baseline Request
+	var points []injectionPoint
+	if request.markedRaw != "" {
+		// Marked raw requests are sent as they were written, with only the marked regions injected into
+		baseline = request
+		points = markerInjectionPoints(request)
+	} else {
+		baseline, err = withMethod(withDefaultContentType(request), rule.Method)
+		if err != nil {
+			return nil, err
+		}
 
-	// Get extra rule injections if exists
-	if len(rule.ExtraParams) != 0 {
-		for _, param := range rule.ExtraParams {
-			if len(queryStrings[param]) == 0 {
-				queryStrings.Add(param, "")
+		// Injection points are taken from the baseline request, including any extra params the rule adds
+		template, err := withExtraParams(baseline, rule.ExtraParams)
+		if err != nil {
+			return nil, err
+		}
+
+		points, err = getInjectionPoints(template, rule.InjectionPoints)
+		if err != nil {
+			return nil, err
+		}
+
+		// Parameters declared by an OpenAPI document are injected into by rules using the default injection points
+		if len(rule.InjectionPoints) == 0 {
+			declaredPoints, err := declaredInjectionPoints(template, points)
+			if err != nil {
+				return nil, err
 			}
+			points = append(points, declaredPoints...)
 		}
 	}
 
-	var expandedRuleInjections []string
+	var requestInjections []RequestInjection
 	for _, ruleInjection := range rule.Injections {
-		expandedRuleInjection := expandInjectionTemplates(ruleInjection, u)
-		expandedRuleInjections = append(expandedRuleInjections, expandedRuleInjection)
-	}
+		injection := expandDelayTemplate(expandInjectionTemplates(ruleInjection, u), rule.Timing.Delay)
+		verifyInjection := expandDelayTemplate(expandInjectionTemplates(ruleInjection, u), rule.Timing.VerifyDelay)
 
-	for _, injection := range expandedRuleInjections {
-		for qs, values := range queryStrings {
-			for index, val := range values {
-				// Only care about the first qs value if there's more than one of the same qs
-				if index > 0 {
+		for _, point := range points {
+			// The payload is sent as it is, and again for each of the rule's encoder chains
+			for _, chain := range append([]string{""}, rule.Encoders...) {
+				token := newTaskToken(injection)
+				payload := expandOriginalValueTemplate(expandTokenTemplates(injection, token), point.OriginalValue)
+				encodedPayload := encodePayload(payload, chain)
+				// Skip encoders that don't change the payload, as it's already sent as it is
+				if chain != "" && encodedPayload == payload {
 					continue
 				}
-				expandedQs := expandQsValueTemplates(injection, qs, queryStrings)
-				urlInjection := UrlInjection{BaselineUrl: u.String()}
-				queryStrings[qs][index] = expandedQs[qs][index]
-				query, err := getInjectedQueryString(queryStrings)
-				if err != nil {
-					if opts.Debug {
-						printRed(os.Stderr, "Error decoding parameters: ", err)
-					}
-				}
-				u.RawQuery = query
-				urlInjection.InjectedUrl = u.String()
 
+				requestInjection := RequestInjection{Baseline: baseline, Location: point.Location, Parameter: point.Name, Payload: encodedPayload, UnencodedPayload: payload, Token: token, Encoders: chain}
+				requestInjection.Injected = point.inject(encodedPayload)
+
+				// Heuristics and verification injections are encoded the same way, so they're comparable
 				if rule.Heuristics.Injection != "" {
-					queryStrings[qs][index] = val
-					heuristicsInjection := expandInjectionTemplates(rule.Heuristics.Injection, u)
-					expandedQs := expandQsValueTemplates(heuristicsInjection, qs, queryStrings)
-					queryStrings[qs][index] = expandedQs[qs][index]
-					query, err := getInjectedQueryString(queryStrings)
-					if err != nil {
-						if opts.Debug {
-							printRed(os.Stderr, "Error decoding parameters: ", err)
-						}
-					}
-					u.RawQuery = query
-					urlInjection.HeuristicsUrl = u.String()
+					heuristicsInjection := expandTokenTemplates(expandInjectionTemplates(rule.Heuristics.Injection, u), token)
+					requestInjection.Heuristics = point.inject(encodePayload(expandOriginalValueTemplate(heuristicsInjection, point.OriginalValue), chain))
 				}
 
-				urlInjections = append(urlInjections, urlInjection)
+				// Time based rules are verified by sending the same injection, but with a different delay
+				if rule.Timing.Delay > 0 {
+					requestInjection.Verify = point.inject(encodePayload(expandOriginalValueTemplate(expandTokenTemplates(verifyInjection, token), point.OriginalValue), chain))
+				}
 
-				// Set back to original qs val to ensure we only update one parameter at a time
-				queryStrings[qs][index] = val
+				requestInjections = append(requestInjections, requestInjection)
 			}
 		}
 	}
-	return urlInjections, nil
+
+	// JSON injections replace JSON body leaves with any JSON value, such as an object or a number, rather than a string
+	for _, ruleInjection := range rule.JsonInjections {
+		injection := expandDelayTemplate(expandInjectionTemplates(ruleInjection, u), rule.Timing.Delay)
+		verifyInjection := expandDelayTemplate(expandInjectionTemplates(ruleInjection, u), rule.Timing.VerifyDelay)
+
+		for _, point := range points {
+			if point.injectJson == nil {
+				continue
+			}
+
+			token := newTaskToken(injection)
+			payload := expandOriginalValueTemplate(expandTokenTemplates(injection, token), point.OriginalValue)
+			value, err := decodeJson(payload)
+			if err != nil {
+				if opts.Debug {
+					printRed(os.Stderr, "invalid JSON injection %v: %v\n", injection, err)
+				}
+				continue
+			}
+
+			requestInjection := RequestInjection{Baseline: baseline, Location: point.Location, Parameter: point.Name, Payload: payload, UnencodedPayload: payload, Token: token}
+			requestInjection.Injected = point.injectJson(value)
+
+			if rule.Heuristics.Injection != "" {
+				heuristicsInjection := expandTokenTemplates(expandInjectionTemplates(rule.Heuristics.Injection, u), token)
+				requestInjection.Heuristics = point.inject(expandOriginalValueTemplate(heuristicsInjection, point.OriginalValue))
+			}
+
+			if rule.Timing.Delay > 0 {
+				verifyPayload := expandOriginalValueTemplate(expandTokenTemplates(verifyInjection, token), point.OriginalValue)
+				verifyValue, err := decodeJson(verifyPayload)
+				if err != nil {
+					if opts.Debug {
+						printRed(os.Stderr, "invalid JSON injection %v: %v\n", verifyInjection, err)
+					}
+					continue
+				}
+				requestInjection.Verify = point.injectJson(verifyValue)
+			}
+
+			requestInjections = append(requestInjections, requestInjection)
+		}
+	}
+	return requestInjections, nil
+}
+
+func sortedParams(values url.Values) []string {
+	params := make([]string, 0, len(values))
+	for param := range values {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	return params
 }
 
 // Makeshift templating check within the YAML files to allow for more dynamic config files
@@ -133,13 +275,73 @@ func expandInjectionTemplates(ruleInjection string, u *url.URL) string {
 	return replacer.Replace(ruleInjection)
 }
 
-func expandQsValueTemplates(ruleInjection string, qs string, queryStrings url.Values) url.Values {
-	replacer := strings.NewReplacer(
-		"[[originalvalue]]", queryStrings.Get(qs),
-	)
-	queryStrings.Set(qs, replacer.Replace(ruleInjection))
-	return queryStrings
+// Templates that are expanded with a token unique to each task. [[random]] and [[canary]] are the token itself, so
+// reflections of it can only have come from the task's own request
+var tokenTemplates = []string{"[[random]]", "[[canary]]", "[[oob]]", "[[ooburl]]"}
+
+// Token templates that are only available when the out-of-band listeners are running
+var oobTemplates = []string{"[[oob]]", "[[ooburl]]"}
+
+const tokenLength = 20
+const tokenAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Generate a token for a task, if its injection uses any token templates. Tokens are lowercase letters and digits,
+// so they can be used as a subdomain
+func newTaskToken(ruleInjection string) string {
+	if !usesTokenTemplates(ruleInjection) {
+		return ""
+	}
+
+	random := make([]byte, tokenLength)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	for i, b := range random {
+		random[i] = tokenAlphabet[int(b)%len(tokenAlphabet)]
+	}
+	return string(random)
+}
 
+func usesTokenTemplates(ruleInjection string) bool {
+	return containsAnyString(ruleInjection, tokenTemplates)
+}
+
+func containsAnyString(value string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(value, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+func expandTokenTemplates(ruleInjection string, token string) string {
+	if token == "" {
+		return ruleInjection
+	}
+
+	replacements := []string{"[[random]]", token, "[[canary]]", token}
+	if oobServer != nil {
+		replacements = append(replacements, "[[oob]]", oobServer.host(token), "[[ooburl]]", oobServer.url(token))
+	}
+	return strings.NewReplacer(replacements...).Replace(ruleInjection)
+}
+
+// Expand the token templates in a regex, quoting what they expand to. Without a token they're matched literally, rather
+// than being parsed as character classes
+func expandTokenTemplatesRegex(pattern string, token string) string {
+	for _, template := range tokenTemplates {
+		pattern = strings.Replace(pattern, template, regexp.QuoteMeta(expandTokenTemplates(template, token)), -1)
+	}
+	return pattern
+}
+
+func expandDelayTemplate(ruleInjection string, delay int) string {
+	return strings.Replace(ruleInjection, "[[delay]]", strconv.Itoa(delay), -1)
+}
+
+func expandOriginalValueTemplate(ruleInjection string, originalValue string) string {
+	return strings.Replace(ruleInjection, "[[originalvalue]]", originalValue, -1)
 }
 
 func getInjectedQueryString(injectedQs url.Values) (string, error) {
@@ -173,3 +375,18 @@ func isLengthWithinTenPercent(expectedLength int, responseLength int) bool {
 	}
 	return false
 }
+
+// Check whether a response took at least most of the injected delay longer than the baseline response
+func isDelayedBy(duration time.Duration, baselineDuration time.Duration, delay int) bool {
+	minimumDelay := time.Duration(float64(delay) * 0.8 * float64(time.Second))
+	return duration-baselineDuration >= minimumDelay
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}